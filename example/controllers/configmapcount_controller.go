@@ -42,10 +42,11 @@ type ConfigMapCountReconciler struct {
 // +kubebuilder:rbac:groups=silly.example.org,resources=configmapcounts/status,verbs=get;update;patch
 
 func (r *ConfigMapCountReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&sillyv1alpha1.ConfigMapCount{}).
-		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, reconciler.EnqueueRequestsForQuery(mgr.GetClient(), r.Log, configMapCountsInTheSameNS)).
-		Complete(reconciler.New(mgr.GetClient(), r.Log, &sillyv1alpha1.ConfigMapCount{}, r.Reconcile))
+	return reconciler.New(mgr.GetClient(), r.Log, &sillyv1alpha1.ConfigMapCount{}, r.Reconcile).
+		SetupWithManager(mgr, ctrl.NewControllerManagedBy(mgr).
+			For(&sillyv1alpha1.ConfigMapCount{}).
+			// ConfigMaps are only watched (and cached) as metadata, the same way they are queried
+			Watches(&source.Kind{Type: function.Metadata(corev1.SchemeGroupVersion.WithKind("ConfigMap"))}, reconciler.EnqueueRequestsForSelector(mgr.GetClient(), r.Log, configMapCountsInTheSameNS, configMapSelector)))
 }
 
 func configMapCountsInTheSameNS(obj client.Object) function.Query {
@@ -55,7 +56,11 @@ func configMapCountsInTheSameNS(obj client.Object) function.Query {
 	}
 }
 
-func (r *ConfigMapCountReconciler) Reconcile(_ context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+func configMapSelector(obj client.Object) (labels.Selector, error) {
+	return labelSelector(obj.(*sillyv1alpha1.ConfigMapCount))
+}
+
+func (r *ConfigMapCountReconciler) Reconcile(ctx context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
 	cmc := object.(*sillyv1alpha1.ConfigMapCount)
 
 	cmSelector, err := labelSelector(cmc)
@@ -63,26 +68,28 @@ func (r *ConfigMapCountReconciler) Reconcile(_ context.Context, object client.Ob
 		return nil, err
 	}
 
+	// only metadata of ConfigMaps is needed to count them
 	cmList := getDetails(function.Query{
 		Namespace: cmc.Namespace,
-		Type:      &corev1.ConfigMapList{},
+		Type:      function.MetadataList(corev1.SchemeGroupVersion.WithKind("ConfigMap")),
 		Selector:  cmSelector,
-	}).(*corev1.ConfigMapList)
+	}).(*metav1.PartialObjectMetadataList)
 
 	cmCount := len(cmList.Items)
 
 	for cmList.Continue != "" {
 		cmList = getDetails(function.Query{
 			Namespace: cmc.Namespace,
-			Type:      &corev1.ConfigMapList{},
+			Type:      function.MetadataList(corev1.SchemeGroupVersion.WithKind("ConfigMap")),
 			Selector:  cmSelector,
 			Options:   []client.ListOption{client.Continue(cmList.Continue)},
-		}).(*corev1.ConfigMapList)
+		}).(*metav1.PartialObjectMetadataList)
 
 		cmCount += len(cmList.Items)
 	}
 
-	r.Log.Info("updated ConfigMap count", "namespace", cmc.Namespace, "count", cmCount)
+	// the reconciler's logger has the object's namespace and name, GVK and reconcile ID
+	logr.FromContextOrDiscard(ctx).Info("updated ConfigMap count", "count", cmCount)
 
 	cmc.Status = sillyv1alpha1.ConfigMapCountStatus{
 		ConfigMaps: cmCount,
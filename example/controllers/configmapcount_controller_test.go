@@ -49,9 +49,10 @@ var _ = Describe("Reconcile", func() {
 			Items: []corev1.ConfigMap{{}, {}}, // len() == 2
 		}
 
-		getDetails := func(query function.Query) runtime.Object {
+		// the reconciler only reads ConfigMaps' metadata: MetadataOnly converts the full objects
+		getDetails := function.MetadataOnly(func(query function.Query) runtime.Object {
 			return expectedCMs
-		}
+		})
 
 		It("should set .status.configMaps to 0", func() {
 			inputCMC := &v1alpha1.ConfigMapCount{}
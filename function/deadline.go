@@ -0,0 +1,36 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"context"
+	"time"
+)
+
+type softDeadlineKey struct{}
+
+// WithSoftDeadline returns a copy of ctx with a soft deadline: the time by which the reconciler function should return
+// (e.g. with Effects done so far), before its context's (hard) deadline cancels its queries.
+func WithSoftDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, softDeadlineKey{}, deadline)
+}
+
+// SoftDeadline returns the soft deadline of ctx, if it's set (see WithSoftDeadline).
+func SoftDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(softDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
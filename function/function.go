@@ -28,31 +28,67 @@ type GetDetails func(query Query) runtime.Object
 
 type ObjectToQuery func(obj client.Object) Query
 
+// ObjectToQueries returns queries for all objects the given object depends on.
+type ObjectToQueries func(obj client.Object) []Query
+
 // Effects specify the changes intended as results of the reconciler function.
 type Effects struct {
 	// Persists lists objects to persist: create or update.
 	//
-	// If an object is being updated, its UID field is recommended to be set (otherwise, the update costs an extra GET
-	// request).
+	// If an object is being updated, its UID field is recommended to be set, and the object obtained with a (not
+	// metadata-only) query: otherwise, the update costs an extra GET request.
 	//
 	// OwnerReferences of persisted objects should have UID field set. The only exception is when an OwnerReference is to
-	// an object being persisted in the same Persists list (and its UID is, obviously, not yet known). In such cases, the
-	// owner object should come earlier in the Persists list, as it is processed sequentially.
+	// an object being persisted in the same Persists list (and its UID is, obviously, not yet known).
+	//
+	// Objects are persisted in dependency order: an object is persisted after its owners from the same Persists list,
+	// and after the objects listed for it in DependsOn. Independent objects may be persisted concurrently (see
+	// reconciler.WithMaxConcurrentPersists), otherwise the list is processed in order.
 	Persists []client.Object
 
+	// DependsOn optionally lists explicit dependencies between objects in Persists: each key object is persisted only
+	// after all of its value objects have been successfully persisted. Both keys and values must be in Persists.
+	DependsOn map[client.Object][]client.Object
+
 	// Deletes lists objects to delete. Deletes are handled after Persists to allow for necessary preparation, like
-	// removing finalizers. It is also processed sequentially.
+	// removing finalizers. It is processed sequentially.
 	Deletes []client.Object
+
+	// Prune lists types (as empty client.ObjectList instances) of objects owned by the reconciled object, for which
+	// Persists is the full desired set. Existing owned objects (by controller OwnerReference or owner labels) of these
+	// types, which are not in Persists, are deleted after Persists and Deletes are handled.
+	Prune []client.ObjectList
+
+	// Clusters optionally maps names of other clusters (see reconciler.WithClusters) to Effects to apply in them, after
+	// the Effects in the reconciled object's cluster. Objects persisted in other clusters get owner labels (OwnerReferences
+	// can't point across clusters), so only these are pruned. Effects in other clusters can't have Clusters themselves.
+	Clusters map[string]*Effects
 }
 
 // Query is a generalized API query - for either Get or List. The Type field is required, and MUST be an empty
 // instance of a client.Object (if Name is non-empty) or client.ObjectList (Selector is an optional
 // filter for the list). Options field is an optional list of []client.ListOption. Namespace and Selector values
 // override those set by Options.
+//
+// Type may also be an *unstructured.Unstructured or *unstructured.UnstructuredList with only GVK set (Kind of a list
+// is the object Kind with "List" suffix, e.g. "ConfigMapList"), to query objects with no Go types.
+//
+// To only get metadata of objects (e.g. to count them, or check their labels or OwnerReferences), use
+// a *metav1.PartialObjectMetadata or *metav1.PartialObjectMetadataList Type (see Metadata and MetadataList): the result
+// is then of the same type, and only metadata of the objects is read and cached.
 type Query struct {
 	Type      runtime.Object
 	Namespace string
 	Name      string
 	Selector  labels.Selector
 	Options   []client.ListOption
+
+	// Live requests an uncached read, straight from the API server (see reconciler.WithAPIReader): e.g. for objects that
+	// must be fresh, or Secrets that shouldn't be cached cluster-wide. Live queries don't start derived watches.
+	Live bool
+
+	// Cluster optionally names the cluster to query (see reconciler.WithClusters): empty means the reconciled object's
+	// cluster. Queries to other clusters are served by their clients as is (Live has no effect), and don't start derived
+	// watches.
+	Cluster string
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Merge merges Effects (nil ones are skipped) into one, keeping the order of objects. The same object may be persisted
+// or deleted by several Effects, as the same instance or equal ones. It is a conflict (and an error) to persist different
+// versions of an object, or to both persist and delete it. Only the first instance is kept in Persists, and DependsOn of
+// the result refers to it.
+func Merge(effects ...*Effects) (*Effects, error) {
+	m := &merger{
+		result:  &Effects{},
+		persist: map[objectKey]client.Object{},
+		delete:  map[objectKey]bool{},
+		prune:   map[objectKey]bool{},
+	}
+	for _, e := range effects {
+		if e == nil {
+			continue
+		}
+		if err := m.merge(e); err != nil {
+			return nil, err
+		}
+	}
+	m.remapDependsOn()
+	return m.result, nil
+}
+
+// objectKey identifies an object by its Go type (or GVK of an unstructured object), namespace and name.
+type objectKey struct {
+	typ       reflect.Type
+	gvk       schema.GroupVersionKind
+	namespace string
+	name      string
+}
+
+func keyOf(object client.Object) objectKey {
+	key := objectKey{typ: reflect.TypeOf(object), namespace: object.GetNamespace(), name: object.GetName()}
+	if u, isUnstructured := object.(*unstructured.Unstructured); isUnstructured {
+		key.gvk = u.GroupVersionKind()
+	}
+	return key
+}
+
+type merger struct {
+	result  *Effects
+	persist map[objectKey]client.Object
+	delete  map[objectKey]bool
+	prune   map[objectKey]bool
+}
+
+// remapDependsOn replaces objects in DependsOn with the (equal) ones kept in Persists.
+func (m *merger) remapDependsOn() {
+	if m.result.DependsOn == nil {
+		return
+	}
+	dependsOn := make(map[client.Object][]client.Object, len(m.result.DependsOn))
+	for object, dependencies := range m.result.DependsOn {
+		object = m.persisted(object)
+		for _, dependency := range dependencies {
+			dependency = m.persisted(dependency)
+			if !contains(dependsOn[object], dependency) {
+				dependsOn[object] = append(dependsOn[object], dependency)
+			}
+		}
+	}
+	m.result.DependsOn = dependsOn
+}
+
+// persisted returns the object kept in Persists for the object, or the object itself, if it's not persisted.
+func (m *merger) persisted(object client.Object) client.Object {
+	if object == nil || reflect.ValueOf(object).IsNil() {
+		return object
+	}
+	if kept, exists := m.persist[keyOf(object)]; exists {
+		return kept
+	}
+	return object
+}
+
+func contains(objects []client.Object, object client.Object) bool {
+	for _, o := range objects {
+		if o == object {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *merger) merge(e *Effects) error {
+	for _, object := range e.Persists {
+		key := keyOf(object)
+		if m.delete[key] {
+			return errors.Errorf("conflict: %T %s/%s is both persisted and deleted", object, key.namespace, key.name)
+		}
+		if existing, exists := m.persist[key]; exists {
+			if existing != object && !reflect.DeepEqual(existing, object) {
+				return errors.Errorf("conflict: different versions of %T %s/%s are persisted", object, key.namespace, key.name)
+			}
+			continue
+		}
+		m.persist[key] = object
+		m.result.Persists = append(m.result.Persists, object)
+	}
+
+	for object, dependencies := range e.DependsOn {
+		if m.result.DependsOn == nil {
+			m.result.DependsOn = map[client.Object][]client.Object{}
+		}
+		m.result.DependsOn[object] = append(m.result.DependsOn[object], dependencies...)
+	}
+
+	for _, object := range e.Deletes {
+		key := keyOf(object)
+		if _, exists := m.persist[key]; exists {
+			return errors.Errorf("conflict: %T %s/%s is both persisted and deleted", object, key.namespace, key.name)
+		}
+		if !m.delete[key] {
+			m.delete[key] = true
+			m.result.Deletes = append(m.result.Deletes, object)
+		}
+	}
+
+	for _, listType := range e.Prune {
+		key := objectKey{typ: reflect.TypeOf(listType)}
+		if u, isUnstructured := listType.(*unstructured.UnstructuredList); isUnstructured {
+			key.gvk = u.GroupVersionKind()
+		}
+		if !m.prune[key] {
+			m.prune[key] = true
+			m.result.Prune = append(m.result.Prune, listType)
+		}
+	}
+
+	for cluster, clusterEffects := range e.Clusters {
+		if clusterEffects == nil {
+			continue
+		}
+		merged, err := Merge(m.result.Clusters[cluster], clusterEffects)
+		if err != nil {
+			return errors.Wrapf(err, "cluster %q", cluster)
+		}
+		if m.result.Clusters == nil {
+			m.result.Clusters = map[string]*Effects{}
+		}
+		m.result.Clusters[cluster] = merged
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Metadata returns a Query Type to get only metadata of a `gvk` object.
+func Metadata(gvk schema.GroupVersionKind) *metav1.PartialObjectMetadata {
+	object := &metav1.PartialObjectMetadata{}
+	object.SetGroupVersionKind(gvk)
+	return object
+}
+
+// MetadataList returns a Query Type to list only metadata of `gvk` objects (`gvk` is the object GVK, not the list's).
+func MetadataList(gvk schema.GroupVersionKind) *metav1.PartialObjectMetadataList {
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return list
+}
+
+// IsMetadataOnly tells if the query is metadata-only: its Type is a *metav1.PartialObjectMetadata or
+// *metav1.PartialObjectMetadataList.
+func (q Query) IsMetadataOnly() bool {
+	switch q.Type.(type) {
+	case *metav1.PartialObjectMetadata, *metav1.PartialObjectMetadataList:
+		return true
+	}
+	return false
+}
+
+// MetadataOnly wraps GetDetails (e.g. a test double returning full objects), so that results of metadata-only queries
+// are converted to *metav1.PartialObjectMetadata and *metav1.PartialObjectMetadataList, as they are by the reconciler.
+func MetadataOnly(getDetails GetDetails) GetDetails {
+	return func(query Query) runtime.Object {
+		result := getDetails(query)
+		if result == nil || !query.IsMetadataOnly() {
+			return result
+		}
+		return asMetadata(query.Type.GetObjectKind().GroupVersionKind(), result)
+	}
+}
+
+func asMetadata(gvk schema.GroupVersionKind, result runtime.Object) runtime.Object {
+	switch result := result.(type) {
+	case *metav1.PartialObjectMetadata, *metav1.PartialObjectMetadataList:
+		return result
+	}
+	if !meta.IsListType(result) {
+		object, err := meta.Accessor(result)
+		if err != nil {
+			panic(err)
+		}
+		metadata := meta.AsPartialObjectMetadata(object)
+		metadata.SetGroupVersionKind(gvk)
+		return metadata
+	}
+
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(gvk)
+	if listMeta, err := meta.ListAccessor(result); err == nil {
+		list.SetResourceVersion(listMeta.GetResourceVersion())
+		list.SetContinue(listMeta.GetContinue())
+		list.SetRemainingItemCount(listMeta.GetRemainingItemCount())
+	}
+	itemGVK := gvk.GroupVersion().WithKind(strings.TrimSuffix(gvk.Kind, "List"))
+	if err := meta.EachListItem(result, func(item runtime.Object) error {
+		object, err := meta.Accessor(item)
+		if err != nil {
+			return err
+		}
+		metadata := meta.AsPartialObjectMetadata(object)
+		metadata.SetGroupVersionKind(itemGVK)
+		list.Items = append(list.Items, *metadata)
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return list
+}
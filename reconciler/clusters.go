@@ -0,0 +1,75 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ClusterRegistry resolves names of clusters (see WithClusters) to their clients.
+type ClusterRegistry interface {
+	Client(cluster string) (client.Client, error)
+}
+
+// Clusters is a static ClusterRegistry, e.g. of fake clients in tests.
+type Clusters map[string]client.Client
+
+func (c Clusters) Client(cluster string) (client.Client, error) {
+	cl, exists := c[cluster]
+	if !exists {
+		return nil, errors.Errorf("unknown cluster %q", cluster)
+	}
+	return cl, nil
+}
+
+// inCluster returns the reconciler to query and apply effects in the named cluster: this one for "" (the reconciled
+// object's cluster), or one with the cluster's client otherwise.
+func (r *reconciler) inCluster(cluster string) (*reconciler, error) {
+	if cluster == "" {
+		return r, nil
+	}
+	if r.clusters == nil {
+		return nil, errors.Errorf("cluster %q: no cluster registry (see WithClusters)", cluster)
+	}
+	cl, err := r.clusters.Client(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return &reconciler{
+		client:                cl,
+		logger:                r.logger.WithValues("cluster", cluster),
+		objType:               r.objType,
+		maxConcurrentPersists: r.maxConcurrentPersists,
+		ownerLabels:           true,
+		maxPrunes:             r.maxPrunes,
+		statusOptimisticLock:  r.statusOptimisticLock,
+		driftDetection:        r.driftDetection,
+		driftHandlers:         r.driftHandlers,
+		remote:                true,
+	}, nil
+}
+
+// clusterCaches holds per-cluster caches of a single reconcile, by cluster name ("" for the reconciled object's cluster).
+type clusterCaches map[string]cache
+
+func (c clusterCaches) get(cluster string) cache {
+	if c[cluster] == nil {
+		c[cluster] = cache{}
+	}
+	return c[cluster]
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestReconcileInClusters(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	management := newFakeClient(primary)
+
+	primaryGK := schema.GroupKind{Kind: "ConfigMap"}
+	primaryName := types.NamespacedName{Namespace: "ns", Name: "primary"}
+	stale := configMap("apps", "stale")
+	stale.UID = "stale-uid"
+	stale.Labels = map[string]string{OwnerLabel: ownerLabelValue(primaryGK, primaryName)}
+	stale.Annotations = map[string]string{
+		OwnerKindAnnotation:      primaryGK.String(),
+		OwnerNamespaceAnnotation: primaryName.Namespace,
+		OwnerNameAnnotation:      primaryName.Name,
+	}
+	workloads := Clusters{
+		"workload-1": newFakeClient(stale, configMap("apps", "unowned")),
+		"workload-2": newFakeClient(),
+	}
+
+	var found int
+	r := New(management, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		found = len(getDetails(function.Query{Type: &corev1.ConfigMapList{}, Namespace: "apps", Cluster: "workload-1"}).(*corev1.ConfigMapList).Items)
+		return &function.Effects{
+			Persists: []client.Object{configMap("ns", "local")},
+			Clusters: map[string]*function.Effects{
+				"workload-1": {Persists: []client.Object{configMap("apps", "app")}, Prune: []client.ObjectList{&corev1.ConfigMapList{}}},
+				"workload-2": {Persists: []client.Object{configMap("apps", "app")}},
+			},
+		}, nil
+	}, WithClusters(workloads), WithDerivedWatches())
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: primaryName})
+	require.NoError(t, err)
+	assert.Equal(t, 2, found)
+	assert.Empty(t, r.dependencies.index, "queries to other clusters don't start derived watches")
+
+	require.NoError(t, management.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "local"}, &corev1.ConfigMap{}))
+	assert.True(t, apierrors.IsNotFound(management.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: "app"}, &corev1.ConfigMap{})))
+	for name, cl := range workloads {
+		app := &corev1.ConfigMap{}
+		require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: "app"}, app), name)
+		owner, isOwned := labeledOwner(primaryGK, app)
+		assert.True(t, isOwned, name)
+		assert.Equal(t, primaryName, owner, name)
+	}
+	assert.True(t, apierrors.IsNotFound(workloads["workload-1"].Get(context.Background(), client.ObjectKeyFromObject(stale), &corev1.ConfigMap{})))
+	require.NoError(t, workloads["workload-1"].Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: "unowned"}, &corev1.ConfigMap{}))
+}
+
+func TestReconcileInUnknownCluster(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+
+	for _, opts := range [][]Option{nil, {WithClusters(Clusters{})}} {
+		r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+			return &function.Effects{Clusters: map[string]*function.Effects{"unknown": {}}}, nil
+		}, opts...)
+		_, err := r.Reconcile(context.Background(), request)
+		assert.Error(t, err)
+
+		r.f = func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+			getDetails(function.Query{Type: &corev1.ConfigMapList{}, Cluster: "unknown"})
+			return nil, nil
+		}
+		_, err = r.Reconcile(context.Background(), request)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// ErrStop is returned by a step of Sequence to stop it: effects of the step and all previous steps are still applied.
+var ErrStop = errors.New("stop")
+
+// Sequence composes Functions (steps) into one, running them in order against the same object and GetDetails (so the
+// steps share its cache). Their Effects are merged with function.Merge: conflicting effects fail the reconcile.
+//
+// A step returning an error stops the sequence, and nothing is applied. A step returning ErrStop (possibly wrapped)
+// stops the sequence too, but effects produced so far (including the step's) are applied.
+func Sequence(steps ...Function) Function {
+	return func(ctx context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		var effects []*function.Effects
+		for i, step := range steps {
+			stepEffects, err := step(ctx, object, getDetails)
+			stop := errors.Is(err, ErrStop)
+			if err != nil && !stop {
+				return nil, errors.Wrapf(err, "step %d", i)
+			}
+			effects = append(effects, stepEffects)
+			if stop {
+				break
+			}
+		}
+		return function.Merge(effects...)
+	}
+}
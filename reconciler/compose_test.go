@@ -0,0 +1,153 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// step returns a Function recording its call and returning the effects and error.
+func step(called *[]int, i int, effects *function.Effects, err error) Function {
+	return func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		*called = append(*called, i)
+		return effects, err
+	}
+}
+
+func TestSequence(t *testing.T) {
+	a, b, c := configMap("ns", "a"), configMap("ns", "b"), configMap("ns", "c")
+
+	var called []int
+	effects, err := Sequence(
+		step(&called, 0, &function.Effects{Persists: []client.Object{a}, Prune: []client.ObjectList{&corev1.ConfigMapList{}}}, nil),
+		step(&called, 1, nil, nil),
+		step(&called, 2, &function.Effects{Persists: []client.Object{a, configMap("ns", "b")}, Deletes: []client.Object{c}, Prune: []client.ObjectList{&corev1.ConfigMapList{}}}, nil),
+	)(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, called)
+	assert.Equal(t, []client.Object{a, b}, effects.Persists)
+	assert.Equal(t, []client.Object{c}, effects.Deletes)
+	assert.Len(t, effects.Prune, 1)
+
+	called = nil
+	expectedErr := errors.New("expected")
+	_, err = Sequence(
+		step(&called, 0, &function.Effects{Persists: []client.Object{a}}, nil),
+		step(&called, 1, nil, expectedErr),
+		step(&called, 2, nil, nil),
+	)(context.Background(), nil, nil)
+	assert.Equal(t, expectedErr, errors.Cause(err))
+	assert.Equal(t, []int{0, 1}, called)
+
+	called = nil
+	effects, err = Sequence(
+		step(&called, 0, &function.Effects{Persists: []client.Object{a}}, nil),
+		step(&called, 1, &function.Effects{Persists: []client.Object{b}}, errors.Wrap(ErrStop, "not ready")),
+		step(&called, 2, nil, nil),
+	)(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, called)
+	assert.Equal(t, []client.Object{a, b}, effects.Persists)
+}
+
+func TestSequenceConflicts(t *testing.T) {
+	changed := configMap("ns", "a")
+	changed.Data = map[string]string{"key": "value"}
+	for name, effects := range map[string][]*function.Effects{
+		"different versions": {{Persists: []client.Object{configMap("ns", "a")}}, {Persists: []client.Object{changed}}},
+		"persist and delete": {{Persists: []client.Object{configMap("ns", "a")}}, {Deletes: []client.Object{configMap("ns", "a")}}},
+		"delete and persist": {{Deletes: []client.Object{configMap("ns", "a")}}, {Persists: []client.Object{configMap("ns", "a")}}},
+		"in a cluster": {
+			{Clusters: map[string]*function.Effects{"remote": {Persists: []client.Object{configMap("ns", "a")}}}},
+			{Clusters: map[string]*function.Effects{"remote": {Persists: []client.Object{changed}}}},
+		},
+	} {
+		var called []int
+		_, err := Sequence(step(&called, 0, effects[0], nil), step(&called, 1, effects[1], nil))(context.Background(), nil, nil)
+		assert.Error(t, err, name)
+	}
+
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name = "ns", "a"
+	effects, err := function.Merge(&function.Effects{Persists: []client.Object{configMap("ns", "a")}}, &function.Effects{Persists: []client.Object{secret}})
+	require.NoError(t, err, "objects of different types don't conflict")
+	assert.Len(t, effects.Persists, 2)
+}
+
+func TestReconcileSequence(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	var queried int
+	manageChild := func(_ context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		getDetails(function.Query{Type: &corev1.ConfigMapList{}, Namespace: "ns"})
+		queried++
+		return &function.Effects{Persists: []client.Object{configMap("ns", "child")}}, nil
+	}
+	updateStatus := func(_ context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		getDetails(function.Query{Type: &corev1.ConfigMapList{}, Namespace: "ns"})
+		queried++
+		object.(*corev1.ConfigMap).Data = map[string]string{"status": "ready"}
+		return &function.Effects{Persists: []client.Object{object}}, nil
+	}
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, Sequence(manageChild, updateStatus))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, queried)
+
+	result := &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKeyFromObject(primary), result))
+	assert.Equal(t, "ready", result.Data["status"])
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, result))
+}
+
+func TestReconcileSequenceSharedDependency(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	// both steps persist their own (equal) instance of the shared ConfigMap, and depend on it
+	dependOnShared := func(name string) Function {
+		return func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+			shared, dependent := configMap("ns", "shared"), configMap("ns", name)
+			return &function.Effects{
+				Persists:  []client.Object{shared, dependent},
+				DependsOn: map[client.Object][]client.Object{dependent: {shared}, shared: {}},
+			}, nil
+		}
+	}
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, Sequence(dependOnShared("a"), dependOnShared("b")))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	require.NoError(t, err)
+	for _, name := range []string{"shared", "a", "b"} {
+		require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: name}, &corev1.ConfigMap{}))
+	}
+}
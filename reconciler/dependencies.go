@@ -0,0 +1,182 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// dependencyGraph orders objects being persisted: an object depends on its owners (via OwnerReferences) being
+// persisted in the same batch, and on objects explicitly listed for it in Effects.DependsOn.
+type dependencyGraph struct {
+	scheme     *runtime.Scheme
+	objects    []client.Object
+	deps       []int   // deps[i] is the number of objects objects[i] depends on
+	dependents [][]int // dependents[i] lists indexes of objects depending on objects[i]
+}
+
+func newDependencyGraph(scheme *runtime.Scheme, objects []client.Object, dependsOn map[client.Object][]client.Object) (*dependencyGraph, error) {
+	g := &dependencyGraph{
+		scheme:     scheme,
+		objects:    objects,
+		deps:       make([]int, len(objects)),
+		dependents: make([][]int, len(objects)),
+	}
+
+	byRef := make(map[corev1.ObjectReference]int, len(objects))
+	byPtr := make(map[client.Object]int, len(objects))
+	for i, object := range objects {
+		byRef[ref(scheme, object)] = i
+		byPtr[object] = i
+	}
+
+	for i, object := range objects {
+		seen := map[int]bool{i: true}
+		addDep := func(j int) {
+			if seen[j] {
+				return
+			}
+			seen[j] = true
+			g.deps[i] += 1
+			g.dependents[j] = append(g.dependents[j], i)
+		}
+		for _, ownerRef := range object.GetOwnerReferences() {
+			if j, exists := byRef[objectRef(ownerRef, object.GetNamespace())]; exists {
+				addDep(j)
+			}
+		}
+		for _, dep := range dependsOn[object] {
+			j, exists := byPtr[dep]
+			if !exists {
+				return nil, errors.Errorf("%s %s/%s depends on %s %s/%s, which is not in Persists list", gvkOf(scheme, object), object.GetNamespace(), object.GetName(), gvkOf(scheme, dep), dep.GetNamespace(), dep.GetName())
+			}
+			addDep(j)
+		}
+	}
+	for object := range dependsOn {
+		if _, exists := byPtr[object]; !exists {
+			return nil, errors.Errorf("DependsOn lists %s %s/%s, which is not in Persists list", gvkOf(scheme, object), object.GetNamespace(), object.GetName())
+		}
+	}
+
+	if err := g.checkCycles(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *dependencyGraph) checkCycles() error {
+	deps := append([]int(nil), g.deps...)
+	ready := g.ready(deps)
+	done := 0
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		done += 1
+		for _, d := range g.dependents[i] {
+			deps[d] -= 1
+			if deps[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if done == len(g.objects) {
+		return nil
+	}
+	for i, n := range deps {
+		if n > 0 {
+			object := g.objects[i]
+			return errors.Errorf("dependency cycle in Persists list involving %s %s/%s", gvkOf(g.scheme, object), object.GetNamespace(), object.GetName())
+		}
+	}
+	return nil
+}
+
+func (g *dependencyGraph) ready(deps []int) []int {
+	var ready []int
+	for i, n := range deps {
+		if n == 0 {
+			ready = append(ready, i)
+		}
+	}
+	return ready
+}
+
+// run calls f for every object, at most `workers` at a time, never before f has succeeded for all objects it depends
+// on. Ready objects are picked in the order of the original list. The first error stops scheduling new calls, cancels
+// the context passed to running ones, and is returned after they finish. Panics in f are recovered as errors (see
+// recoverPanic), as they can't be recovered by the caller.
+func (g *dependencyGraph) run(ctx context.Context, workers int, f func(ctx context.Context, object client.Object) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+
+	deps := append([]int(nil), g.deps...)
+	ready := g.ready(deps)
+	running := 0
+	var firstErr error
+
+	for {
+		for firstErr == nil && running < workers && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running += 1
+			go func() {
+				var err error
+				defer func() {
+					results <- result{i: i, err: err}
+				}()
+				defer func() {
+					err = recoverPanic(recover(), err, logr.FromContextOrDiscard(ctx), "persist")
+				}()
+				err = f(ctx, g.objects[i])
+			}()
+		}
+		if running == 0 {
+			return firstErr
+		}
+
+		res := <-results
+		running -= 1
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			continue
+		}
+		for _, d := range g.dependents[res.i] {
+			deps[d] -= 1
+			if deps[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+		sort.Ints(ready)
+	}
+}
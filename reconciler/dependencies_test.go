@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestDependencyGraphOrder(t *testing.T) {
+	a, b, c := configMap("ns", "a"), configMap("ns", "b"), configMap("ns", "c")
+	a.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "c"}}
+
+	graph, err := newDependencyGraph(clientgoscheme.Scheme, []client.Object{a, b, c}, map[client.Object][]client.Object{c: {b}})
+	require.NoError(t, err)
+
+	var order []string
+	err = graph.run(context.Background(), 1, func(_ context.Context, object client.Object) error {
+		order = append(order, object.GetName())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "a"}, order)
+}
+
+func TestDependencyGraphConcurrent(t *testing.T) {
+	objects := []client.Object{configMap("ns", "a"), configMap("ns", "b"), configMap("ns", "c")}
+	graph, err := newDependencyGraph(clientgoscheme.Scheme, objects, nil)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(len(objects))
+	err = graph.run(context.Background(), len(objects), func(_ context.Context, object client.Object) error {
+		wg.Done()
+		wg.Wait() // blocks forever unless all objects are processed concurrently
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestDependencyGraphError(t *testing.T) {
+	a, b := configMap("ns", "a"), configMap("ns", "b")
+	graph, err := newDependencyGraph(clientgoscheme.Scheme, []client.Object{a, b}, map[client.Object][]client.Object{b: {a}})
+	require.NoError(t, err)
+
+	expectedErr := errors.New("expected")
+	var called []string
+	err = graph.run(context.Background(), 2, func(_ context.Context, object client.Object) error {
+		called = append(called, object.GetName())
+		return expectedErr
+	})
+	assert.Equal(t, expectedErr, err)
+	assert.Equal(t, []string{"a"}, called)
+}
+
+func TestDependencyGraphPanic(t *testing.T) {
+	a, b := configMap("ns", "a"), configMap("ns", "b")
+	graph, err := newDependencyGraph(clientgoscheme.Scheme, []client.Object{a, b}, map[client.Object][]client.Object{b: {a}})
+	require.NoError(t, err)
+
+	var called []string
+	err = graph.run(context.Background(), 1, func(_ context.Context, object client.Object) error {
+		called = append(called, object.GetName())
+		var m map[string]string
+		m["boom"] = "" // panics
+		return nil
+	})
+	require.IsType(t, &PanicError{}, err)
+	assert.Equal(t, []string{"a"}, called)
+}
+
+func TestDependencyGraphCycle(t *testing.T) {
+	a, b := configMap("ns", "a"), configMap("ns", "b")
+	a.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "b"}}
+
+	_, err := newDependencyGraph(clientgoscheme.Scheme, []client.Object{a, b}, map[client.Object][]client.Object{b: {a}})
+	assert.Error(t, err)
+
+	_, err = newDependencyGraph(clientgoscheme.Scheme, []client.Object{a}, map[client.Object][]client.Object{a: {b}})
+	assert.Error(t, err)
+}
+
+func TestReconcileOwnerAfterChild(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		owner, child := configMap("ns", "owner"), configMap("ns", "child")
+		child.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "owner"}}
+		return &function.Effects{Persists: []client.Object{child, owner}}, nil
+	}, WithMaxConcurrentPersists(4))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+
+	owner, child := &corev1.ConfigMap{}, &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "owner"}, owner))
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, child))
+	require.Len(t, child.OwnerReferences, 1)
+	assert.Equal(t, owner.UID, child.OwnerReferences[0].UID)
+}
+
+func TestReconcileOwnerWithoutTypeMeta(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "owner"}}
+		child := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "child"}}
+		child.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "owner"}}
+		return &function.Effects{Persists: []client.Object{child, owner}}, nil
+	})
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+
+	owner, child := &corev1.ConfigMap{}, &corev1.Secret{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "owner"}, owner))
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, child))
+	require.Len(t, child.OwnerReferences, 1)
+	assert.Equal(t, owner.UID, child.OwnerReferences[0].UID)
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DriftIgnoreAnnotation on a persisted object lists (comma-separated) fields users are allowed to change: the
+// reconciler keeps their live values instead of reverting them, and doesn't report them as drift. Fields are
+// dot-separated paths, like in IgnoreFieldUpdates, e.g. "spec.replicas,metadata.annotations.example\.org/owner".
+const DriftIgnoreAnnotation = "controllers-af.io/drift-ignore"
+
+// LastAppliedAnnotation holds the desired state of a persisted object last applied by the reconciler, as JSON (see
+// WithDriftDetection): labels, annotations and fields outside metadata and status.
+const LastAppliedAnnotation = "controllers-af.io/last-applied"
+
+// DriftHandler is called (see WithDriftDetection) with a persisted object about to be patched, and its fields
+// changed since the reconciler last applied it.
+type DriftHandler func(ctx context.Context, object client.Object, fields []string)
+
+// driftIgnored returns paths of fields listed in DriftIgnoreAnnotation of the object.
+func driftIgnored(object client.Object) [][]string {
+	annotation, exists := object.GetAnnotations()[DriftIgnoreAnnotation]
+	if !exists {
+		return nil
+	}
+	var paths [][]string
+	for _, field := range strings.Split(annotation, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			paths = append(paths, fieldPath(field))
+		}
+	}
+	return paths
+}
+
+// ignoreDrift copies fields listed in DriftIgnoreAnnotation of the live object (and the annotation itself) to the
+// desired object, so that patching it doesn't revert them.
+func ignoreDrift(live, desired client.Object) error {
+	if _, exists := live.GetAnnotations()[DriftIgnoreAnnotation]; !exists {
+		return nil
+	}
+	paths := append([][]string{{"metadata", "annotations", DriftIgnoreAnnotation}}, driftIgnored(live)...)
+
+	liveContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return err
+	}
+	desiredContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		value, found, err := unstructured.NestedFieldNoCopy(liveContent, path...)
+		if err != nil || !found {
+			unstructured.RemoveNestedField(desiredContent, path...)
+			continue
+		}
+		if err := unstructured.SetNestedField(desiredContent, value, path...); err != nil {
+			return err
+		}
+	}
+
+	if u, isUnstructured := desired.(*unstructured.Unstructured); isUnstructured {
+		u.Object = desiredContent
+		return nil
+	}
+	updated := newEmpty(desired)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(desiredContent, updated); err != nil {
+		return err
+	}
+	reflect.ValueOf(desired).Elem().Set(reflect.ValueOf(updated).Elem())
+	return nil
+}
+
+// managedContent returns JSON content of the object managed by the reconciler: labels, annotations (except
+// LastAppliedAnnotation and DriftIgnoreAnnotation) and fields outside metadata and status.
+func managedContent(object client.Object) (map[string]interface{}, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	delete(content, "apiVersion")
+	delete(content, "kind")
+	delete(content, "status")
+
+	metadata, _ := content["metadata"].(map[string]interface{})
+	managed := map[string]interface{}{}
+	if labels, exists := metadata["labels"]; exists {
+		managed["labels"] = labels
+	}
+	if annotations, isMap := metadata["annotations"].(map[string]interface{}); isMap {
+		delete(annotations, LastAppliedAnnotation)
+		delete(annotations, DriftIgnoreAnnotation)
+		if len(annotations) > 0 {
+			managed["annotations"] = annotations
+		}
+	}
+	delete(content, "metadata")
+	if len(managed) > 0 {
+		content["metadata"] = managed
+	}
+	return content, nil
+}
+
+// setLastApplied records the desired state of the object in its LastAppliedAnnotation.
+func setLastApplied(object client.Object) error {
+	content, err := managedContent(object)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[LastAppliedAnnotation] = string(data)
+	object.SetAnnotations(annotations)
+	return nil
+}
+
+// lastApplied returns the desired state last applied to the object, or nil if it isn't recorded (or can't be parsed).
+func lastApplied(object client.Object) map[string]interface{} {
+	data, exists := object.GetAnnotations()[LastAppliedAnnotation]
+	if !exists {
+		return nil
+	}
+	content := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &content); err != nil {
+		return nil
+	}
+	return content
+}
+
+// driftedFields lists fields of the live object changed since the desired state was `applied`, which the patch to the
+// desired object would revert: fields that were applied and differ now (and in the desired object), and fields added
+// since, which the patch would remove. Fields listed in DriftIgnoreAnnotation are left out.
+func driftedFields(live, desired client.Object, applied map[string]interface{}) ([]string, error) {
+	liveContent, err := managedContent(live)
+	if err != nil {
+		return nil, err
+	}
+	desiredContent, err := managedContent(desired)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.MergeFrom(live).Data(desired)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+
+	var changed, paths [][]string
+	changedFields(nil, applied, liveContent, &changed)
+	for _, path := range changed {
+		if !reflect.DeepEqual(valueAt(liveContent, path), valueAt(desiredContent, path)) {
+			paths = append(paths, path)
+		}
+	}
+	removedFields(nil, patch, applied, liveContent, &paths)
+
+	ignored := driftIgnored(live)
+	fields := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !hasPrefix(path, ignored) {
+			fields = append(fields, joinPath(path))
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// changedFields adds paths of fields in `applied` that differ in `live`. Lists are compared by item.
+func changedFields(path []string, applied, live interface{}, paths *[][]string) {
+	switch applied := applied.(type) {
+	case nil:
+	case map[string]interface{}:
+		liveMap, isMap := live.(map[string]interface{})
+		if !isMap {
+			if len(applied) > 0 {
+				*paths = append(*paths, path)
+			}
+			return
+		}
+		for key, value := range applied {
+			changedFields(appendPath(path, key), value, liveMap[key], paths)
+		}
+	case []interface{}:
+		liveList, isList := live.([]interface{})
+		if !isList || len(liveList) != len(applied) {
+			*paths = append(*paths, path)
+			return
+		}
+		for i, value := range applied {
+			changedFields(appendPath(path, strconv.Itoa(i)), value, liveList[i], paths)
+		}
+	default:
+		if !reflect.DeepEqual(applied, live) {
+			*paths = append(*paths, path)
+		}
+	}
+}
+
+// removedFields adds paths of fields the merge patch removes (sets to null), that are in `live` but weren't applied.
+func removedFields(path []string, patch map[string]interface{}, applied, live interface{}, paths *[][]string) {
+	appliedMap, _ := applied.(map[string]interface{})
+	liveMap, _ := live.(map[string]interface{})
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			_, inLive := liveMap[key]
+			_, wasApplied := appliedMap[key]
+			if inLive && !wasApplied {
+				leafFields(appendPath(path, key), liveMap[key], paths)
+			}
+		case map[string]interface{}:
+			removedFields(appendPath(path, key), value, appliedMap[key], liveMap[key], paths)
+		}
+	}
+}
+
+// leafFields adds paths of fields in the value: the path itself, unless it's a non-empty map.
+func leafFields(path []string, value interface{}, paths *[][]string) {
+	m, isMap := value.(map[string]interface{})
+	if !isMap || len(m) == 0 {
+		*paths = append(*paths, path)
+		return
+	}
+	for key, v := range m {
+		leafFields(appendPath(path, key), v, paths)
+	}
+}
+
+// valueAt returns the value at the path in the content (with list items indexed by number), or nil if there's none.
+func valueAt(content interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch c := content.(type) {
+		case map[string]interface{}:
+			content = c[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil
+			}
+			content = c[i]
+		default:
+			return nil
+		}
+	}
+	return content
+}
+
+func appendPath(path []string, key string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), key)
+}
+
+// joinPath joins the path with dots, escaping dots in field names (like IgnoreFieldUpdates expects).
+func joinPath(path []string) string {
+	escaped := make([]string, len(path))
+	for i, key := range path {
+		escaped[i] = strings.ReplaceAll(key, ".", `\.`)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// hasPrefix tells whether the path is (in) one of the prefixes.
+func hasPrefix(path []string, prefixes [][]string) bool {
+	for _, prefix := range prefixes {
+		if len(prefix) <= len(path) && reflect.DeepEqual(prefix, path[:len(prefix)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportDrift reports the object's drifted fields (if any) with the drift metric, a Drifted event and DriftHandlers.
+func (r *reconciler) reportDrift(ctx context.Context, live, desired client.Object, applied map[string]interface{}) error {
+	fields, err := driftedFields(live, desired, applied)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	gvk := gvkOf(r.client.Scheme(), desired)
+	drifts.WithLabelValues(gvk.GroupKind().String()).Inc()
+	logr.FromContextOrDiscard(ctx).V(summaryLogLevel).Info("drift", "gvk", gvk, "namespace", desired.GetNamespace(), "name", desired.GetName(), "fields", fields)
+	r.event(live, corev1.EventTypeWarning, "Drifted", "Fields differ from the desired state: %s", strings.Join(fields, ", "))
+	for _, handler := range r.driftHandlers {
+		if err := callDriftHandler(ctx, handler, desired, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callDriftHandler calls the handler, recovering its panic as PanicError: it runs on a persist worker goroutine.
+func callDriftHandler(ctx context.Context, handler DriftHandler, object client.Object, fields []string) (err error) {
+	defer func() {
+		err = recoverPanic(recover(), err, logr.FromContextOrDiscard(ctx), "drift")
+	}()
+	handler(ctx, object, fields)
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func reconcileChild(t *testing.T, cl client.Client, value string, opts ...Option) {
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		child := configMap("ns", "child")
+		child.Data = map[string]string{"a": value}
+		return &function.Effects{Persists: []client.Object{child}}, nil
+	}, opts...)
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+}
+
+func getChild(t *testing.T, cl client.Client) *corev1.ConfigMap {
+	child := &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, child))
+	return child
+}
+
+func TestDriftDetection(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	recorder := record.NewFakeRecorder(10)
+	var drifted []string
+	opts := []Option{WithEventRecorder(recorder), WithDriftDetection(func(_ context.Context, object client.Object, fields []string) {
+		assert.Equal(t, "child", object.GetName())
+		drifted = fields
+	})}
+
+	// changes of the desired state are not drift
+	reconcileChild(t, cl, "1", opts...)
+	assert.Equal(t, `{"data":{"a":"1"}}`, getChild(t, cl).Annotations[LastAppliedAnnotation])
+	reconcileChild(t, cl, "2", opts...)
+	assert.Nil(t, drifted)
+	assert.Empty(t, events(recorder))
+
+	edited := getChild(t, cl)
+	edited.Data = map[string]string{"a": "edited", "extra": "added"}
+	edited.Labels = map[string]string{"added": "by-hand"}
+	require.NoError(t, cl.Update(context.Background(), edited))
+
+	before := testutil.ToFloat64(drifts.WithLabelValues("ConfigMap"))
+	reconcileChild(t, cl, "2", opts...)
+	assert.Equal(t, []string{"data.a", "data.extra", "metadata.labels.added"}, drifted)
+	assert.Equal(t, []string{"Warning Drifted Fields differ from the desired state: data.a, data.extra, metadata.labels.added"}, events(recorder))
+	assert.Equal(t, before+1, testutil.ToFloat64(drifts.WithLabelValues("ConfigMap")))
+	assert.Equal(t, map[string]string{"a": "2"}, getChild(t, cl).Data)
+}
+
+func TestDriftWithoutLastApplied(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	child := configMap("ns", "child")
+	child.Data = map[string]string{"a": "edited"}
+	cl := newFakeClient(primary, child)
+
+	var drifted []string
+	reconcileChild(t, cl, "1", WithDriftDetection(func(_ context.Context, _ client.Object, fields []string) {
+		drifted = fields
+	}))
+	assert.Nil(t, drifted)
+	assert.Equal(t, `{"data":{"a":"1"}}`, getChild(t, cl).Annotations[LastAppliedAnnotation])
+}
+
+func TestDriftIgnoreAnnotation(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	var drifted []string
+	opts := []Option{WithDriftDetection(func(_ context.Context, _ client.Object, fields []string) {
+		drifted = fields
+	})}
+	reconcileChild(t, cl, "1", opts...)
+
+	edited := getChild(t, cl)
+	edited.Annotations[DriftIgnoreAnnotation] = "data.b"
+	edited.Data = map[string]string{"a": "edited", "b": "user"}
+	require.NoError(t, cl.Update(context.Background(), edited))
+
+	reconcileChild(t, cl, "1", opts...)
+	assert.Equal(t, []string{"data.a"}, drifted)
+
+	updated := getChild(t, cl)
+	assert.Equal(t, map[string]string{"a": "1", "b": "user"}, updated.Data)
+	assert.Equal(t, "data.b", updated.Annotations[DriftIgnoreAnnotation])
+}
+
+func TestDriftedFields(t *testing.T) {
+	desired := configMap("ns", "cm")
+	desired.Annotations = map[string]string{"example.org/owner": "controller"}
+	desired.Data = map[string]string{"key": "value"}
+	require.NoError(t, setLastApplied(desired))
+	applied := lastApplied(desired)
+
+	live := desired.DeepCopy()
+	live.ResourceVersion = "5"
+	live.Annotations["example.org/owner"] = "someone"
+	live.Annotations["example.org/added"] = "someone"
+	live.BinaryData = map[string][]byte{"added": []byte("x")}
+
+	fields, err := driftedFields(live, desired, applied)
+	require.NoError(t, err)
+	assert.Equal(t, []string{`binaryData.added`, `metadata.annotations.example\.org/added`, `metadata.annotations.example\.org/owner`}, fields)
+}
+
+func TestDriftMatchingDesiredState(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	var drifted []string
+	opts := []Option{WithDriftDetection(func(_ context.Context, _ client.Object, fields []string) {
+		drifted = fields
+	})}
+	reconcileChild(t, cl, "1", opts...)
+
+	// edited the same way as the desired state changes: nothing to revert
+	edited := getChild(t, cl)
+	edited.Data["a"] = "2"
+	require.NoError(t, cl.Update(context.Background(), edited))
+	reconcileChild(t, cl, "2", opts...)
+	assert.Nil(t, drifted)
+}
+
+func TestDriftOfReconciledObject(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	primary.Data = map[string]string{"spec": "1"}
+	cl := newFakeClient(primary)
+
+	var drifted []string
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, object client.Object, _ function.GetDetails) (*function.Effects, error) {
+		object.(*corev1.ConfigMap).Data["status"] = "ready"
+		return &function.Effects{Persists: []client.Object{object}}, nil
+	}, WithDriftDetection(func(_ context.Context, _ client.Object, fields []string) {
+		drifted = fields
+	}))
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+
+	edited := &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), request.NamespacedName, edited))
+	assert.NotContains(t, edited.Annotations, LastAppliedAnnotation)
+	edited.Data["spec"] = "2"
+	require.NoError(t, cl.Update(context.Background(), edited))
+
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Nil(t, drifted)
+}
+
+func TestDriftHandlerPanic(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	opts := []Option{WithDriftDetection(func(context.Context, client.Object, []string) {
+		var m map[string]string
+		m["boom"] = "" // panics
+	})}
+	reconcileChild(t, cl, "1", opts...)
+	edited := getChild(t, cl)
+	edited.Data["a"] = "edited"
+	require.NoError(t, cl.Update(context.Background(), edited))
+
+	before := testutil.ToFloat64(panics.WithLabelValues("drift"))
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		child := configMap("ns", "child")
+		child.Data = map[string]string{"a": "1"}
+		return &function.Effects{Persists: []client.Object{child}}, nil
+	}, opts...)
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	var panicErr *PanicError
+	require.True(t, errors.As(err, &panicErr), "expected a PanicError, got: %v", err)
+	assert.Equal(t, before+1, testutil.ToFloat64(panics.WithLabelValues("drift")))
+}
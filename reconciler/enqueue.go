@@ -0,0 +1,201 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// DefaultEnqueueTimeout is the default deadline for mapping a single event to reconcile requests.
+const DefaultEnqueueTimeout = 30 * time.Second
+
+// EnqueueOption configures event handlers created by EnqueueRequestsForQuery and EnqueueRequestsForSelector.
+type EnqueueOption func(o *enqueueOptions)
+
+type enqueueOptions struct {
+	ctx        context.Context
+	timeout    time.Duration
+	retries    int
+	retryAfter time.Duration
+}
+
+// EnqueueContext sets the parent context of queries run by the handler: e.g. cancelled on shutdown.
+func EnqueueContext(ctx context.Context) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.ctx = ctx
+	}
+}
+
+// EnqueueTimeout sets the deadline for mapping a single event to reconcile requests. Default is DefaultEnqueueTimeout.
+// Zero means no deadline.
+func EnqueueTimeout(timeout time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.timeout = timeout
+	}
+}
+
+// EnqueueRetry makes the handler retry failed mappings (up to `retries` times) after a delay. By default, failed
+// mappings are only logged and counted.
+func EnqueueRetry(retries int, after time.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.retries = retries
+		o.retryAfter = after
+	}
+}
+
+func newEnqueueOptions(opts []EnqueueOption) enqueueOptions {
+	o := enqueueOptions{
+		ctx:     context.Background(),
+		timeout: DefaultEnqueueTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// enqueuer is a handler.EventHandler enqueuing requests produced by mapFunc from event objects (old and new ones for
+// update events).
+type enqueuer struct {
+	name    string
+	log     logr.Logger
+	opts    enqueueOptions
+	mapFunc func(ctx context.Context, objects ...client.Object) ([]reconcile.Request, error)
+}
+
+func (e *enqueuer) Create(evt event.CreateEvent, q workqueue.RateLimitingInterface) {
+	e.enqueue(q, 0, evt.Object)
+}
+
+func (e *enqueuer) Update(evt event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	e.enqueue(q, 0, evt.ObjectOld, evt.ObjectNew)
+}
+
+func (e *enqueuer) Delete(evt event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	e.enqueue(q, 0, evt.Object)
+}
+
+func (e *enqueuer) Generic(evt event.GenericEvent, q workqueue.RateLimitingInterface) {
+	e.enqueue(q, 0, evt.Object)
+}
+
+func (e *enqueuer) enqueue(q workqueue.RateLimitingInterface, attempt int, objects ...client.Object) {
+	ctx, cancel := e.opts.ctx, context.CancelFunc(func() {})
+	if e.opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.opts.timeout)
+	}
+	defer cancel()
+
+	requests, err := e.mapObjects(ctx, objects)
+	if err != nil {
+		enqueueErrors.WithLabelValues(e.name).Inc()
+		object := objects[len(objects)-1]
+		e.log.Error(err, "mapping object to reconcile requests", "namespace", object.GetNamespace(), "name", object.GetName(), "attempt", attempt)
+		if attempt < e.opts.retries && e.opts.ctx.Err() == nil {
+			time.AfterFunc(e.opts.retryAfter, func() {
+				e.enqueue(q, attempt+1, objects...)
+			})
+		}
+		return
+	}
+	for _, request := range requests {
+		q.Add(request)
+	}
+}
+
+// SelectorOf returns the label selector of a primary object, selecting objects it depends on. A nil selector (e.g. of
+// a primary object without one) selects nothing.
+type SelectorOf func(primary client.Object) (labels.Selector, error)
+
+// EnqueueRequestsForSelector is like EnqueueRequestsForQuery, but it only enqueues primary objects (found by the query)
+// whose selector matches labels of the event object. For update events, primary objects matching either old or new
+// labels are enqueued: so that both the ones that gained and lost the object are reconciled.
+func EnqueueRequestsForSelector(c client.Client, log logr.Logger, toQuery function.ObjectToQuery, selectorOf SelectorOf, opts ...EnqueueOption) handler.EventHandler {
+	return &enqueuer{
+		name: "selector",
+		log:  log,
+		opts: newEnqueueOptions(opts),
+		mapFunc: func(ctx context.Context, objects ...client.Object) ([]reconcile.Request, error) {
+			query := toQuery(objects[len(objects)-1])
+			primaries, err := queryObjects(ctx, c, query)
+			if err != nil {
+				return nil, errors.Wrapf(err, "running query %+v", query)
+			}
+			var result []reconcile.Request
+			for _, primary := range primaries {
+				selector, err := selectorOf(primary)
+				if err != nil {
+					log.Error(err, "getting selector", "namespace", primary.GetNamespace(), "name", primary.GetName())
+					continue
+				}
+				if selector == nil {
+					continue
+				}
+				for _, object := range objects {
+					if selector.Matches(labels.Set(object.GetLabels())) {
+						result = append(result, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+						break
+					}
+				}
+			}
+			return result, nil
+		},
+	}
+}
+
+// queryObjects runs the query and returns all found objects (including metadata-only ones).
+func queryObjects(ctx context.Context, c client.Client, query function.Query) ([]client.Object, error) {
+	found, err := runQuery(ctx, c, cache{}, query)
+	if err != nil || found == nil {
+		return nil, err
+	}
+	if !meta.IsListType(found) {
+		return []client.Object{found.(client.Object)}, nil
+	}
+	var result []client.Object
+	err = meta.EachListItem(found, func(item runtime.Object) error {
+		object, isObject := item.(client.Object)
+		if !isObject {
+			return errors.Errorf("casting %T to client.Object type", item)
+		}
+		result = append(result, object)
+		return nil
+	})
+	return result, err
+}
+
+// mapObjects maps the objects to requests, recovering panics (e.g. in user-provided functions) as errors.
+func (e *enqueuer) mapObjects(ctx context.Context, objects []client.Object) (requests []reconcile.Request, err error) {
+	defer func() {
+		err = recoverPanic(recover(), err, e.log, e.name)
+	}()
+	return e.mapFunc(ctx, objects...)
+}
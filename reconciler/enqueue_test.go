@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func secretsInTheSameNS(obj client.Object) function.Query {
+	return function.Query{Type: &corev1.SecretList{}, Namespace: obj.GetNamespace()}
+}
+
+func TestEnqueueRequestsForSelector(t *testing.T) {
+	cl := newFakeClient(primarySecret("a", "app=a"), primarySecret("b", "app=b"), primarySecret("c", "app=c"))
+	h := EnqueueRequestsForSelector(cl, logr.Discard(), secretsInTheSameNS, selectorAnnotation)
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	cm := configMap("ns", "cm")
+	cm.Labels = map[string]string{"app": "a"}
+	h.Create(event.CreateEvent{Object: cm}, q)
+	assert.Equal(t, []string{"a"}, queued(q))
+
+	updated := cm.DeepCopy()
+	updated.Labels["app"] = "b"
+	h.Update(event.UpdateEvent{ObjectOld: cm, ObjectNew: updated}, q)
+	assert.ElementsMatch(t, []string{"a", "b"}, queued(q))
+
+	h.Delete(event.DeleteEvent{Object: updated}, q)
+	assert.Equal(t, []string{"b"}, queued(q))
+}
+
+func TestEnqueueRequestsForNilSelector(t *testing.T) {
+	cl := newFakeClient(primarySecret("a", "app=a"), primarySecret("none", ""))
+	selectorOrNil := func(primary client.Object) (labels.Selector, error) {
+		if primary.GetAnnotations()["selector"] == "" {
+			return nil, nil
+		}
+		return selectorAnnotation(primary)
+	}
+	h := EnqueueRequestsForSelector(cl, logr.Discard(), secretsInTheSameNS, selectorOrNil)
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	cm := configMap("ns", "cm")
+	cm.Labels = map[string]string{"app": "a"}
+	h.Create(event.CreateEvent{Object: cm}, q)
+	assert.Equal(t, []string{"a"}, queued(q))
+}
+
+// flakyClient fails the first `failures` List calls, blocking until the context is done.
+type flakyClient struct {
+	client.Client
+	failures int32
+}
+
+func (c *flakyClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		<-ctx.Done()
+		return errors.Wrap(ctx.Err(), "listing")
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestEnqueueRequestsForQueryTimeoutAndRetry(t *testing.T) {
+	cl := &flakyClient{Client: newFakeClient(primarySecret("a", "")), failures: 3}
+	h := EnqueueRequestsForQuery(cl, logr.Discard(), secretsInTheSameNS, EnqueueTimeout(10*time.Millisecond), EnqueueRetry(1, 10*time.Millisecond))
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	errorsBefore := testutil.ToFloat64(enqueueErrors.WithLabelValues("query"))
+
+	// both mappings time out, one of their retries fails too, and the other succeeds
+	h.Generic(event.GenericEvent{Object: configMap("ns", "cm")}, q)
+	h.Generic(event.GenericEvent{Object: configMap("ns", "cm")}, q)
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a"}, queued(q))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(enqueueErrors.WithLabelValues("query")) == errorsBefore+3
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// uidClient assigns UIDs to created objects, like the API server does (and the fake client does not).
+type uidClient struct {
+	client.Client
+}
+
+func (c uidClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	obj.SetUID(uuid.NewUUID())
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func newFakeClient(objects ...client.Object) client.Client {
+	return uidClient{fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objects...).Build()}
+}
+
+func configMap(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+	}
+}
+
+var configMapGVK = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+
+// fakeController records started watches.
+type fakeController struct {
+	reconcile.Reconciler
+	watches []source.Source
+}
+
+func (c *fakeController) Watch(src source.Source, _ handler.EventHandler, _ ...predicate.Predicate) error {
+	c.watches = append(c.watches, src)
+	return nil
+}
+
+func (c *fakeController) Start(context.Context) error { return nil }
+
+func (c *fakeController) GetLogger() logr.Logger { return logr.Discard() }
+
+// primary Secrets select ConfigMaps with their "selector" annotation
+func selectorAnnotation(primary client.Object) (labels.Selector, error) {
+	return labels.Parse(primary.GetAnnotations()["selector"])
+}
+
+func primarySecret(name, selector string) *corev1.Secret {
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name, secret.UID = "ns", name, types.UID(name+"-uid")
+	secret.Annotations = map[string]string{"selector": selector}
+	return secret
+}
+
+func queued(q workqueue.Interface) []string {
+	var names []string
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		names = append(names, item.(reconcile.Request).Name)
+		q.Done(item)
+	}
+	return names
+}
+
+// events returns events recorded so far.
+func events(recorder *record.FakeRecorder) []string {
+	var result []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
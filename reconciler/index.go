@@ -0,0 +1,112 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// QueryIndex is an in-memory reverse index from watched objects to primary objects depending on them. It is an
+// alternative to EnqueueRequestsForQuery answering events without API requests.
+//
+// The index is built from queries returned for each primary object by the function.ObjectToQueries function, and is
+// kept up to date by watching primary objects with the ForPrimaries() handler:
+//
+//  idx := reconciler.NewQueryIndex(mgr.GetClient(), log, configMapsOfConfigMapCount)
+//  ctrl.NewControllerManagedBy(mgr).
+//  	For(&ConfigMapCount{}).
+//  	Watches(&source.Kind{Type: &ConfigMapCount{}}, idx.ForPrimaries()).
+//  	Watches(&source.Kind{Type: &corev1.ConfigMap{}}, idx.EnqueueRequests())
+type QueryIndex struct {
+	c         client.Client
+	log       logr.Logger
+	toQueries function.ObjectToQueries
+	deps      *dependencyIndex
+}
+
+// NewQueryIndex creates a QueryIndex. The client is only used for its scheme.
+func NewQueryIndex(c client.Client, log logr.Logger, toQueries function.ObjectToQueries) *QueryIndex {
+	return &QueryIndex{
+		c:         c,
+		log:       log,
+		toQueries: toQueries,
+		deps:      newDependencyIndex(),
+	}
+}
+
+// ForPrimaries returns a handler.EventHandler maintaining the index: use it to watch primary objects. It doesn't
+// enqueue anything.
+func (idx *QueryIndex) ForPrimaries() handler.EventHandler {
+	return handler.Funcs{
+		CreateFunc: func(e event.CreateEvent, _ workqueue.RateLimitingInterface) {
+			idx.update(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent, _ workqueue.RateLimitingInterface) {
+			idx.update(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent, _ workqueue.RateLimitingInterface) {
+			idx.deps.forget(client.ObjectKeyFromObject(e.Object))
+		},
+		GenericFunc: func(e event.GenericEvent, _ workqueue.RateLimitingInterface) {
+			idx.update(e.Object)
+		},
+	}
+}
+
+// update indexes queries of the primary object, recovering panics (e.g. in toQueries) like enqueue handlers do.
+func (idx *QueryIndex) update(primary client.Object) {
+	log := idx.log.WithValues("namespace", primary.GetNamespace(), "name", primary.GetName())
+	defer func() {
+		_ = recoverPanic(recover(), nil, log, "index")
+	}()
+	queries := idx.toQueries(primary)
+	deps := make([]dependency, 0, len(queries))
+	for _, query := range queries {
+		dep, err := newDependency(idx.c.Scheme(), query)
+		if err != nil {
+			idx.log.Error(err, "indexing query", "query", query)
+			continue
+		}
+		deps = append(deps, dep)
+	}
+	idx.deps.set(client.ObjectKeyFromObject(primary), deps)
+}
+
+// EnqueueRequests returns a handler.EventHandler enqueuing primary objects depending on the event objects.
+func (idx *QueryIndex) EnqueueRequests() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
+		return idx.Requests(object)
+	})
+}
+
+// Requests returns requests for primary objects depending on the object.
+func (idx *QueryIndex) Requests(object client.Object) []reconcile.Request {
+	gvk, err := apiutil.GVKForObject(object, idx.c.Scheme())
+	if err != nil {
+		idx.log.Error(err, "resolving GVK", "object", client.ObjectKeyFromObject(object))
+		return nil
+	}
+	return idx.deps.requests(gvk, object)
+}
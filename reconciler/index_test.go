@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestQueryIndex(t *testing.T) {
+	// primaries are ConfigMaps depending on ConfigMaps labeled with their "selector" annotation
+	idx := NewQueryIndex(newFakeClient(), logr.Discard(), func(obj client.Object) []function.Query {
+		return []function.Query{{
+			Type:      &corev1.ConfigMapList{},
+			Namespace: obj.GetNamespace(),
+			Selector:  labels.SelectorFromSet(labels.Set{"app": obj.GetAnnotations()["selector"]}),
+		}}
+	})
+	handler := idx.ForPrimaries()
+
+	primary := configMap("ns", "primary")
+	primary.Annotations = map[string]string{"selector": "a"}
+	handler.Create(event.CreateEvent{Object: primary}, nil)
+
+	watched := &corev1.ConfigMap{}
+	watched.Namespace, watched.Labels = "ns", map[string]string{"app": "a"}
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	assert.Equal(t, []reconcile.Request{request}, idx.Requests(watched))
+
+	updated := primary.DeepCopy()
+	updated.Annotations["selector"] = "b"
+	handler.Update(event.UpdateEvent{ObjectOld: primary, ObjectNew: updated}, nil)
+	assert.Empty(t, idx.Requests(watched))
+	watched.Labels["app"] = "b"
+	assert.Equal(t, []reconcile.Request{request}, idx.Requests(watched))
+
+	handler.Delete(event.DeleteEvent{Object: updated}, nil)
+	assert.Empty(t, idx.Requests(watched))
+}
+
+func TestQueryIndexPanic(t *testing.T) {
+	idx := NewQueryIndex(newFakeClient(), logr.Discard(), func(obj client.Object) []function.Query {
+		var queries map[string]function.Query
+		queries["boom"] = function.Query{} // panics
+		return nil
+	})
+
+	before := testutil.ToFloat64(panics.WithLabelValues("index"))
+	assert.NotPanics(t, func() {
+		idx.ForPrimaries().Create(event.CreateEvent{Object: configMap("ns", "primary")}, nil)
+	})
+	assert.Equal(t, before+1, testutil.ToFloat64(panics.WithLabelValues("index")))
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Verbosity levels of the reconciler's logs: the per-reconcile summary, and details of each query and write.
+const (
+	summaryLogLevel = 1
+	detailLogLevel  = 2
+)
+
+// requestLogger returns the logger of a single reconcile: with the request's namespace and name, the reconciled object
+// GVK, and a unique reconcile ID. Reconcile passes it to the Function in the context: get it with logr.FromContext.
+func (r *reconciler) requestLogger(request reconcile.Request) logr.Logger {
+	log := r.logger.WithValues("namespace", request.Namespace, "name", request.Name)
+	if gvk, err := apiutil.GVKForObject(r.objType, r.client.Scheme()); err == nil {
+		log = log.WithValues("gvk", gvk.String())
+	}
+	return log.WithValues("reconcileID", string(uuid.NewUUID()))
+}
+
+// reconcileStats counts writes of a single reconcile.
+type reconcileStats struct {
+	created, patched, unchanged, deleted int64
+}
+
+type statsKey struct{}
+
+func withStats(ctx context.Context) (context.Context, *reconcileStats) {
+	stats := &reconcileStats{}
+	return context.WithValue(ctx, statsKey{}, stats), stats
+}
+
+// statsFrom returns stats of the reconcile of ctx (or throwaway ones, if it's not counted).
+func statsFrom(ctx context.Context) *reconcileStats {
+	if stats, _ := ctx.Value(statsKey{}).(*reconcileStats); stats != nil {
+		return stats
+	}
+	return &reconcileStats{}
+}
+
+// written counts (and logs) a write of the reconcile of ctx: `action` is "created", "patched", "unchanged" or
+// "deleted".
+func written(ctx context.Context, object client.Object, action string) {
+	stats := statsFrom(ctx)
+	switch action {
+	case "created":
+		atomic.AddInt64(&stats.created, 1)
+	case "patched":
+		atomic.AddInt64(&stats.patched, 1)
+	case "unchanged":
+		atomic.AddInt64(&stats.unchanged, 1)
+	case "deleted":
+		atomic.AddInt64(&stats.deleted, 1)
+	}
+	logr.FromContextOrDiscard(ctx).V(detailLogLevel).Info(action, "object", fmt.Sprintf("%T %s", object, client.ObjectKeyFromObject(object)))
+}
+
+// logSummary logs the summary of a reconcile: queries issued by the Function, counts of writes, and duration.
+func logSummary(log logr.Logger, start time.Time, queries *queryLog, stats *reconcileStats, err error) {
+	queries.Lock()
+	described := make([]string, 0, len(queries.queries))
+	for _, query := range queries.queries {
+		described = append(described, query.String())
+	}
+	queries.Unlock()
+
+	keysAndValues := []interface{}{
+		"queries", described,
+		"created", atomic.LoadInt64(&stats.created),
+		"patched", atomic.LoadInt64(&stats.patched),
+		"unchanged", atomic.LoadInt64(&stats.unchanged),
+		"deleted", atomic.LoadInt64(&stats.deleted),
+		"duration", time.Since(start).String(),
+	}
+	if err != nil {
+		keysAndValues = append(keysAndValues, "error", err.Error())
+	}
+	log.V(summaryLogLevel).Info("reconciled", keysAndValues...)
+}
+
+// String describes the query, e.g. "Deployment.apps ns/name" or "ConfigMap ns app=x (live)".
+func (q loggedQuery) String() string {
+	var b strings.Builder
+	b.WriteString(q.gvk.GroupKind().String())
+	switch {
+	case q.name != "" && q.namespace != "":
+		b.WriteString(" " + q.namespace + "/" + q.name)
+	case q.name != "":
+		b.WriteString(" " + q.name)
+	case q.namespace != "":
+		b.WriteString(" " + q.namespace)
+	}
+	if q.selector != nil && !q.selector.Empty() {
+		b.WriteString(" " + q.selector.String())
+	}
+	if q.metadataOnly {
+		b.WriteString(" (metadata)")
+	}
+	if q.live {
+		b.WriteString(" (live)")
+	}
+	if q.cluster != "" {
+		b.WriteString(" in cluster " + q.cluster)
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// logLine is a message logged by recordingLogger, with its verbosity level and values (including those of the logger).
+type logLine struct {
+	level  int
+	msg    string
+	values map[string]interface{}
+}
+
+// recordingLogger records logged lines.
+type recordingLogger struct {
+	lines  *[]logLine
+	mu     *sync.Mutex
+	level  int
+	values []interface{}
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{lines: &[]logLine{}, mu: &sync.Mutex{}}
+}
+
+func (l recordingLogger) Enabled() bool { return true }
+
+func (l recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := logLine{level: l.level, msg: msg, values: map[string]interface{}{}}
+	all := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i+1 < len(all); i += 2 {
+		line.values[all[i].(string)] = all[i+1]
+	}
+	*l.lines = append(*l.lines, line)
+}
+
+func (l recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.Info(msg, append(keysAndValues, "error", err)...)
+}
+
+func (l recordingLogger) V(level int) logr.Logger {
+	l.level += level
+	return l
+}
+
+func (l recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	l.values = append(append([]interface{}{}, l.values...), keysAndValues...)
+	return l
+}
+
+func (l recordingLogger) WithName(string) logr.Logger { return l }
+
+func (l recordingLogger) find(msg string) []logLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var result []logLine
+	for _, line := range *l.lines {
+		if line.msg == msg {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func TestReconcileLogging(t *testing.T) {
+	primary, existing := configMap("ns", "primary"), configMap("ns", "existing")
+	primary.UID, existing.UID = "primary-uid", "existing-uid"
+	cl := newFakeClient(primary, existing, configMap("ns", "obsolete"))
+	log := newRecordingLogger()
+
+	r := New(cl, log, &corev1.ConfigMap{}, func(ctx context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		logr.FromContextOrDiscard(ctx).Info("from the function")
+		getDetails(function.Query{Type: &corev1.ConfigMapList{}, Namespace: "ns"})
+		getDetails(function.Query{Type: &corev1.Secret{}, Namespace: "ns", Name: "credentials"})
+		updated := existing.DeepCopy()
+		updated.Data = map[string]string{"key": "value"}
+		return &function.Effects{
+			Persists: []client.Object{object, updated, configMap("ns", "new")},
+			Deletes:  []client.Object{configMap("ns", "obsolete")},
+		}, nil
+	})
+
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	_, err = r.Reconcile(context.Background(), request)
+	assert.Error(t, err, "deleting the obsolete ConfigMap fails the second time")
+
+	fromFunction := log.find("from the function")
+	require.Len(t, fromFunction, 2)
+	assert.Equal(t, "ns", fromFunction[0].values["namespace"])
+	assert.Equal(t, "primary", fromFunction[0].values["name"])
+	assert.Equal(t, "/v1, Kind=ConfigMap", fromFunction[0].values["gvk"])
+	assert.NotEmpty(t, fromFunction[0].values["reconcileID"])
+	assert.NotEqual(t, fromFunction[0].values["reconcileID"], fromFunction[1].values["reconcileID"])
+
+	summaries := log.find("reconciled")
+	require.Len(t, summaries, 2)
+	summary := summaries[0]
+	assert.Equal(t, summaryLogLevel, summary.level)
+	assert.Equal(t, fromFunction[0].values["reconcileID"], summary.values["reconcileID"])
+	assert.Equal(t, []string{"ConfigMap ns", "Secret ns/credentials"}, summary.values["queries"])
+	assert.Equal(t, int64(1), summary.values["created"])
+	assert.Equal(t, int64(1), summary.values["patched"])
+	assert.Equal(t, int64(1), summary.values["unchanged"])
+	assert.Equal(t, int64(1), summary.values["deleted"])
+	assert.NotEmpty(t, summary.values["duration"])
+	assert.NotContains(t, summary.values, "error")
+
+	assert.Contains(t, summaries[1].values, "error")
+	assert.Len(t, log.find("query"), 4)
+}
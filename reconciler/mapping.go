@@ -0,0 +1,187 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// maxOwnerDepth limits how far ToOwner walks up OwnerReferences.
+const maxOwnerDepth = 16
+
+// Mapping maps an object to related objects: e.g. the object referenced by it, or its owner. Mappings read objects with
+// function.GetDetails, so they can be tested without an API server (see MappingRequests).
+type Mapping func(object client.Object, getDetails function.GetDetails) []client.Object
+
+// EnqueueRequestsForMapping creates a handler.EventHandler enqueuing objects the event objects are mapped to.
+func EnqueueRequestsForMapping(c client.Client, log logr.Logger, mapping Mapping, opts ...EnqueueOption) handler.EventHandler {
+	return &enqueuer{
+		name: "mapping",
+		log:  log,
+		opts: newEnqueueOptions(opts),
+		mapFunc: func(ctx context.Context, objects ...client.Object) ([]reconcile.Request, error) {
+			getDetails := func(query function.Query) runtime.Object {
+				result, err := runQuery(ctx, c, cache{}, query)
+				if err != nil {
+					panic(queryPanic{err}) // recovered by the enqueuer
+				}
+				return result
+			}
+			var result []reconcile.Request
+			for _, object := range objects {
+				result = append(result, MappingRequests(mapping, object, getDetails)...)
+			}
+			return result, nil
+		},
+	}
+}
+
+// MappingRequests returns reconcile requests for objects the object is mapped to. Use it to test your mappings.
+func MappingRequests(mapping Mapping, object client.Object, getDetails function.GetDetails) []reconcile.Request {
+	var result []reconcile.Request
+	seen := map[types.NamespacedName]bool{}
+	for _, mapped := range mapping(object, getDetails) {
+		name := client.ObjectKeyFromObject(mapped)
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, reconcile.Request{NamespacedName: name})
+		}
+	}
+	return result
+}
+
+// Chain creates a multi-hop Mapping: each mapping is applied to the objects produced by the previous one.
+func Chain(mappings ...Mapping) Mapping {
+	return func(object client.Object, getDetails function.GetDetails) []client.Object {
+		objects := []client.Object{object}
+		for _, mapping := range mappings {
+			var next []client.Object
+			for _, object := range objects {
+				next = append(next, mapping(object, getDetails)...)
+			}
+			objects = next
+		}
+		return objects
+	}
+}
+
+// FromQuery maps an object to all objects found by its query.
+func FromQuery(toQuery function.ObjectToQuery) Mapping {
+	return func(object client.Object, getDetails function.GetDetails) []client.Object {
+		switch result := getDetails(toQuery(object)).(type) {
+		case nil:
+			return nil
+		case client.ObjectList:
+			var objects []client.Object
+			_ = meta.EachListItem(result, func(item runtime.Object) error {
+				objects = append(objects, item.(client.Object))
+				return nil
+			})
+			return objects
+		case client.Object:
+			return []client.Object{result}
+		}
+		return nil
+	}
+}
+
+// FollowRef maps an object to the object of `targetType` it references, e.g. via spec.targetRef. The `ref` function
+// extracts the reference from the object (nil if there is none). An empty reference namespace means the object's
+// namespace.
+func FollowRef(targetType client.Object, ref func(object client.Object) *types.NamespacedName) Mapping {
+	return func(object client.Object, getDetails function.GetDetails) []client.Object {
+		name := ref(object)
+		if name == nil || name.Name == "" {
+			return nil
+		}
+		namespace := name.Namespace
+		if namespace == "" {
+			namespace = object.GetNamespace()
+		}
+		target := getDetails(function.Query{Type: newEmpty(targetType), Namespace: namespace, Name: name.Name})
+		if target == nil {
+			return nil
+		}
+		return []client.Object{target.(client.Object)}
+	}
+}
+
+// FromAnnotation maps an object to the object of `targetType` named by its annotation, either as "name" (in the
+// object's namespace) or "namespace/name".
+func FromAnnotation(targetType client.Object, annotation string) Mapping {
+	return FollowRef(targetType, func(object client.Object) *types.NamespacedName {
+		value, exists := object.GetAnnotations()[annotation]
+		if !exists {
+			return nil
+		}
+		if i := strings.Index(value, "/"); i >= 0 {
+			return &types.NamespacedName{Namespace: value[:i], Name: value[i+1:]}
+		}
+		return &types.NamespacedName{Name: value}
+	})
+}
+
+// ToOwner walks controller OwnerReferences up from the object, until it reaches an owner of `ownerType`. Types of
+// intermediate owners are resolved with the scheme (owners of types unknown to the scheme are read as unstructured).
+func ToOwner(scheme *runtime.Scheme, ownerType client.Object) Mapping {
+	return func(object client.Object, getDetails function.GetDetails) []client.Object {
+		ownerGVK, err := apiutil.GVKForObject(ownerType, scheme)
+		if err != nil {
+			panic(errors.Wrapf(err, "resolving GVK of %T", ownerType))
+		}
+		current := object
+		for i := 0; i < maxOwnerDepth; i++ {
+			ownerRef := v1.GetControllerOf(current)
+			if ownerRef == nil {
+				return nil
+			}
+			gvk := schema.FromAPIVersionAndKind(ownerRef.APIVersion, ownerRef.Kind)
+			queryType, err := newObject(scheme, gvk)
+			if err != nil {
+				return nil
+			}
+			found := getDetails(function.Query{Type: queryType, Namespace: current.GetNamespace(), Name: ownerRef.Name})
+			if found == nil {
+				return nil
+			}
+			owner := found.(client.Object)
+			if owner.GetUID() != ownerRef.UID {
+				return nil // the owner has been deleted and re-created
+			}
+			if gvk.GroupKind() == ownerGVK.GroupKind() {
+				return []client.Object{owner}
+			}
+			current = owner
+		}
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// objectsGetDetails is a function.GetDetails finding objects by type, namespace and name.
+func objectsGetDetails(objects ...client.Object) function.GetDetails {
+	return func(query function.Query) runtime.Object {
+		for _, object := range objects {
+			if reflect.TypeOf(object) == reflect.TypeOf(query.Type) && object.GetNamespace() == query.Namespace && object.GetName() == query.Name {
+				return object
+			}
+		}
+		return nil
+	}
+}
+
+func controlledBy(object client.Object, apiVersion, kind string, owner client.Object) {
+	object.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       owner.GetName(),
+		UID:        owner.GetUID(),
+		Controller: pointer.BoolPtr(true),
+	}})
+}
+
+func TestMappings(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app", UID: "deployment-uid"}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app-1", UID: "rs-uid"}}
+	controlledBy(replicaSet, "apps/v1", "Deployment", deployment)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app-1-x", UID: "pod-uid"}}
+	controlledBy(pod, "apps/v1", "ReplicaSet", replicaSet)
+	cm := configMap("other-ns", "cm")
+	cm.Annotations = map[string]string{"pod": "ns/app-1-x"}
+	getDetails := objectsGetDetails(deployment, replicaSet, pod, cm)
+
+	toDeployment := ToOwner(clientgoscheme.Scheme, &appsv1.Deployment{})
+	deploymentRequest := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "app"}}
+	assert.Equal(t, []reconcile.Request{deploymentRequest}, MappingRequests(toDeployment, pod, getDetails))
+	assert.Equal(t, []reconcile.Request{deploymentRequest}, MappingRequests(toDeployment, replicaSet, getDetails))
+	assert.Empty(t, MappingRequests(toDeployment, deployment, getDetails))
+
+	chain := Chain(FromAnnotation(&corev1.Pod{}, "pod"), toDeployment)
+	assert.Equal(t, []reconcile.Request{deploymentRequest}, MappingRequests(chain, cm, getDetails))
+
+	cm.Annotations["pod"] = "app-1-x" // in the ConfigMap's namespace
+	assert.Empty(t, MappingRequests(chain, cm, getDetails))
+
+	replicaSet.UID = "recreated-rs-uid"
+	assert.Empty(t, MappingRequests(toDeployment, pod, getDetails))
+}
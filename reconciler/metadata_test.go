@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// metadataClient serves metadata-only reads from full objects, like the API server does (and the fake client does not).
+type metadataClient struct {
+	client.Client
+}
+
+func (c metadataClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	metadata, isMetadata := obj.(*metav1.PartialObjectMetadata)
+	if !isMetadata {
+		return c.Client.Get(ctx, key, obj)
+	}
+	full, err := c.Scheme().New(metadata.GroupVersionKind())
+	if err != nil {
+		return err
+	}
+	if err := c.Client.Get(ctx, key, full.(client.Object)); err != nil {
+		return err
+	}
+	gvk := metadata.GroupVersionKind()
+	*metadata = *meta.AsPartialObjectMetadata(full.(client.Object))
+	metadata.SetGroupVersionKind(gvk)
+	return nil
+}
+
+func (c metadataClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	metadata, isMetadata := list.(*metav1.PartialObjectMetadataList)
+	if !isMetadata {
+		return c.Client.List(ctx, list, opts...)
+	}
+	full, err := c.Scheme().New(metadata.GroupVersionKind())
+	if err != nil {
+		return err
+	}
+	if err := c.Client.List(ctx, full.(client.ObjectList), opts...); err != nil {
+		return err
+	}
+	gvk := metadata.GroupVersionKind()
+	itemGVK := gvk.GroupVersion().WithKind(strings.TrimSuffix(gvk.Kind, "List"))
+	metadata.Items = nil
+	return meta.EachListItem(full, func(item runtime.Object) error {
+		object := meta.AsPartialObjectMetadata(item.(client.Object))
+		object.SetGroupVersionKind(itemGVK)
+		metadata.Items = append(metadata.Items, *object)
+		return nil
+	})
+}
+
+// watchedType returns the type of objects watched by a source created with source.NewKindWithCache.
+func watchedType(src source.Source) reflect.Type {
+	return reflect.ValueOf(src).Elem().FieldByName("kind").FieldByName("Type").Elem().Type()
+}
+
+func TestReconcileMetadataOnly(t *testing.T) {
+	primary, counted := configMap("ns", "primary"), configMap("ns", "counted")
+	primary.UID, counted.UID = "primary-uid", "counted-uid"
+	cl := metadataClient{newFakeClient(primary, counted)}
+
+	var listed *metav1.PartialObjectMetadataList
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		listed = getDetails(function.Query{Type: function.MetadataList(configMapGVK), Namespace: "ns"}).(*metav1.PartialObjectMetadataList)
+		for _, item := range listed.Items {
+			if item.Name == "counted" {
+				// a persisted object only known by its metadata is fetched before patching
+				cm := configMap(item.Namespace, item.Name)
+				cm.UID = item.UID
+				cm.Labels = map[string]string{"counted": "true"}
+				return &function.Effects{Persists: []client.Object{cm}}, nil
+			}
+		}
+		return nil, nil
+	}, WithDerivedWatches())
+	c := &fakeController{}
+	r.watches.setController(c, nil)
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, listed.Items, 2)
+	assert.Equal(t, configMapGVK, listed.Items[0].GroupVersionKind())
+
+	result := &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKeyFromObject(counted), result))
+	assert.Equal(t, map[string]string{"counted": "true"}, result.Labels)
+
+	require.Len(t, c.watches, 1)
+	assert.Equal(t, reflect.TypeOf(&metav1.PartialObjectMetadata{}), watchedType(c.watches[0]))
+	assert.Equal(t, []reconcile.Request{request}, r.dependencies.requests(configMapGVK, counted))
+}
+
+func TestMetadataOnly(t *testing.T) {
+	cm := configMap("ns", "cm")
+	cm.Labels = map[string]string{"app": "x"}
+	getDetails := function.MetadataOnly(func(query function.Query) runtime.Object {
+		if query.Name != "" {
+			return cm
+		}
+		return &corev1.ConfigMapList{ListMeta: metav1.ListMeta{Continue: "next"}, Items: []corev1.ConfigMap{*cm}}
+	})
+
+	list := getDetails(function.Query{Type: function.MetadataList(configMapGVK), Namespace: "ns"}).(*metav1.PartialObjectMetadataList)
+	assert.Equal(t, "ConfigMapList", list.Kind)
+	assert.Equal(t, "next", list.Continue)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, configMapGVK, list.Items[0].GroupVersionKind())
+	assert.Equal(t, cm.Labels, list.Items[0].Labels)
+
+	object := getDetails(function.Query{Type: function.Metadata(configMapGVK), Namespace: "ns", Name: "cm"}).(*metav1.PartialObjectMetadata)
+	assert.Equal(t, configMapGVK, object.GroupVersionKind())
+	assert.Equal(t, "cm", object.Name)
+
+	assert.Same(t, cm, getDetails(function.Query{Type: &corev1.ConfigMap{}, Namespace: "ns", Name: "cm"}))
+}
+
+func TestEnqueueRequestsForMetadataQuery(t *testing.T) {
+	cl := metadataClient{newFakeClient(primarySecret("a", "app=a"), primarySecret("b", "app=b"))}
+	secretsMetadata := func(obj client.Object) function.Query {
+		return function.Query{Type: function.MetadataList(corev1.SchemeGroupVersion.WithKind("Secret")), Namespace: obj.GetNamespace()}
+	}
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	EnqueueRequestsForQuery(cl, logr.Discard(), secretsMetadata).Create(event.CreateEvent{Object: configMap("ns", "cm")}, q)
+	assert.ElementsMatch(t, []string{"a", "b"}, queued(q))
+
+	cm := configMap("ns", "cm")
+	cm.Labels = map[string]string{"app": "b"}
+	EnqueueRequestsForSelector(cl, logr.Discard(), secretsMetadata, selectorAnnotation).Create(event.CreateEvent{Object: cm}, q)
+	assert.Equal(t, []string{"b"}, queued(q))
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	enqueueErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "controllers_af_enqueue_errors_total",
+		Help: "Total number of errors mapping watched objects to reconcile requests, per handler",
+	}, []string{"handler"})
+
+	functionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "controllers_af_function_duration_seconds",
+		Help: "Durations of reconciler Function calls (see Timing), per Function name",
+	}, []string{"function"})
+
+	timeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "controllers_af_reconcile_timeouts_total",
+		Help: "Total number of reconciles failed after exceeding a time budget, per phase (reconcile, function or apply)",
+	}, []string{"phase"})
+
+	panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "controllers_af_panics_total",
+		Help: "Total number of recovered panics, per source (reconcile, or the handler name)",
+	}, []string{"source"})
+
+	drifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "controllers_af_drifts_total",
+		Help: "Total number of persisted objects found differing from the desired state (see WithDriftDetection), per kind",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		enqueueErrors,
+		functionDuration,
+		timeouts,
+		panics,
+		drifts,
+	)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// Middleware wraps a Function into another Function: e.g. to skip, time or log it (see WithMiddleware and Hooks).
+type Middleware func(next Function) Function
+
+// Hooks builds a Middleware calling the set hook functions around the Function.
+type Hooks struct {
+	// Before is called before the Function. An error fails the reconcile, unless it's ErrStop: then the Function is
+	// skipped, and there are no effects to apply.
+	Before func(ctx context.Context, object client.Object) error
+
+	// AfterEffects is called with the results of the Function, and returns the results to apply (e.g. the same ones).
+	AfterEffects func(ctx context.Context, object client.Object, effects *function.Effects, err error) (*function.Effects, error)
+
+	// AfterApply is called after the reconciler has applied the effects: with the error applying them, if any. It's not
+	// called if the Function failed. Its context is the reconcile's, as the Function's one is done by then.
+	AfterApply func(ctx context.Context, object client.Object, effects *function.Effects, err error)
+}
+
+// Middleware returns the Middleware calling the hooks.
+func (h Hooks) Middleware() Middleware {
+	return func(next Function) Function {
+		return func(ctx context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+			if h.Before != nil {
+				if err := h.Before(ctx, object); err != nil {
+					if errors.Is(err, ErrStop) {
+						return nil, nil
+					}
+					return nil, err
+				}
+			}
+			effects, err := next(ctx, object, getDetails)
+			if h.AfterEffects != nil {
+				effects, err = h.AfterEffects(ctx, object, effects, err)
+			}
+			if h.AfterApply != nil && err == nil {
+				onApplied(ctx, func(ctx context.Context, applyErr error) {
+					h.AfterApply(ctx, object, effects, applyErr)
+				})
+			}
+			return effects, err
+		}
+	}
+}
+
+type onAppliedKey struct{}
+
+// appliedCallbacks are called by the reconciler after applying effects of a Function, with the reconcile context.
+type appliedCallbacks struct {
+	sync.Mutex
+	callbacks []func(ctx context.Context, err error)
+}
+
+func withAppliedCallbacks(ctx context.Context) (context.Context, *appliedCallbacks) {
+	callbacks := &appliedCallbacks{}
+	return context.WithValue(ctx, onAppliedKey{}, callbacks), callbacks
+}
+
+func (c *appliedCallbacks) call(ctx context.Context, err error) {
+	c.Lock()
+	callbacks := c.callbacks
+	c.Unlock()
+	for _, callback := range callbacks {
+		callback(ctx, err)
+	}
+}
+
+// OnApplied registers `f` to be called once the reconciler has applied effects returned by the Function: with the
+// error applying them, if any. `ctx` must be the one passed to the Function, otherwise `f` is never called.
+func OnApplied(ctx context.Context, f func(err error)) {
+	onApplied(ctx, func(_ context.Context, err error) {
+		f(err)
+	})
+}
+
+func onApplied(ctx context.Context, f func(ctx context.Context, err error)) {
+	callbacks, _ := ctx.Value(onAppliedKey{}).(*appliedCallbacks)
+	if callbacks == nil {
+		return
+	}
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	callbacks.callbacks = append(callbacks.callbacks, f)
+}
+
+// Logging logs the reconciled object, and the effects produced and applied (at V(1)).
+func Logging(log logr.Logger) Middleware {
+	return Hooks{
+		Before: func(_ context.Context, object client.Object) error {
+			log.V(1).Info("reconciling", "namespace", object.GetNamespace(), "name", object.GetName())
+			return nil
+		},
+		AfterEffects: func(_ context.Context, object client.Object, effects *function.Effects, err error) (*function.Effects, error) {
+			if err != nil {
+				log.Error(err, "reconciler function failed", "namespace", object.GetNamespace(), "name", object.GetName())
+				return effects, err
+			}
+			if effects != nil {
+				log.V(1).Info("effects", "namespace", object.GetNamespace(), "name", object.GetName(),
+					"persists", len(effects.Persists), "deletes", len(effects.Deletes), "prunes", len(effects.Prune), "clusters", len(effects.Clusters))
+			}
+			return effects, err
+		},
+		AfterApply: func(_ context.Context, object client.Object, _ *function.Effects, err error) {
+			if err != nil {
+				log.Error(err, "applying effects", "namespace", object.GetNamespace(), "name", object.GetName())
+				return
+			}
+			log.V(1).Info("applied effects", "namespace", object.GetNamespace(), "name", object.GetName())
+		},
+	}.Middleware()
+}
+
+// Timing records durations of the Function (not including applying its effects) in the
+// controllers_af_function_duration_seconds histogram, labeled with `name`.
+func Timing(name string) Middleware {
+	return func(next Function) Function {
+		return func(ctx context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+			start := time.Now()
+			defer func() {
+				functionDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			}()
+			return next(ctx, object, getDetails)
+		}
+	}
+}
+
+// NamespaceAllowlist skips the Function for objects outside of `namespaces` (cluster-scoped objects are reconciled
+// only if "" is in the list).
+func NamespaceAllowlist(namespaces ...string) Middleware {
+	allowed := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		allowed[namespace] = true
+	}
+	return Hooks{
+		Before: func(_ context.Context, object client.Object) error {
+			if !allowed[object.GetNamespace()] {
+				return ErrStop
+			}
+			return nil
+		},
+	}.Middleware()
+}
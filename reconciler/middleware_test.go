@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// recording returns a Middleware recording calls of the Function it wraps, tagged with `name`.
+func recording(calls *[]string, name string) Middleware {
+	return Hooks{
+		Before: func(context.Context, client.Object) error {
+			*calls = append(*calls, "before "+name)
+			return nil
+		},
+		AfterEffects: func(_ context.Context, _ client.Object, effects *function.Effects, err error) (*function.Effects, error) {
+			*calls = append(*calls, "effects "+name)
+			return effects, err
+		},
+		AfterApply: func(_ context.Context, _ client.Object, _ *function.Effects, err error) {
+			if err != nil {
+				name += " (failed)"
+			}
+			*calls = append(*calls, "applied "+name)
+		},
+	}.Middleware()
+}
+
+func TestReconcileWithMiddleware(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	var calls []string
+	var effects *function.Effects
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		calls = append(calls, "function")
+		return effects, nil
+	}, WithMiddleware(recording(&calls, "outer"), recording(&calls, "inner")), WithMiddleware(Logging(logr.Discard())))
+
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"before outer", "before inner", "function", "effects inner", "effects outer", "applied inner", "applied outer"}, calls)
+
+	calls = nil
+	effects = &function.Effects{Deletes: []client.Object{configMap("ns", "missing")}}
+	_, err = r.Reconcile(context.Background(), request)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"before outer", "before inner", "function", "effects inner", "effects outer", "applied inner (failed)", "applied outer (failed)"}, calls)
+}
+
+func TestAfterApplyContext(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	var ctxErr, onAppliedErr error
+	applied := false
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(ctx context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		OnApplied(ctx, func(err error) {
+			onAppliedErr = err
+		})
+		return &function.Effects{Persists: []client.Object{configMap("ns", "child")}}, nil
+	}, WithMiddleware(Hooks{
+		AfterApply: func(ctx context.Context, _ client.Object, _ *function.Effects, _ error) {
+			applied = true
+			ctxErr = ctx.Err()
+		},
+	}.Middleware()), WithFunctionTimeout(time.Minute))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.NoError(t, ctxErr)
+	assert.NoError(t, onAppliedErr)
+}
+
+func TestNamespaceAllowlist(t *testing.T) {
+	allowed, other := configMap("allowed", "primary"), configMap("other", "primary")
+	cl := newFakeClient(allowed, other)
+
+	var reconciled []string
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, object client.Object, _ function.GetDetails) (*function.Effects, error) {
+		reconciled = append(reconciled, object.GetNamespace())
+		return nil, nil
+	}, WithMiddleware(NamespaceAllowlist("allowed")))
+
+	for _, object := range []client.Object{allowed, other} {
+		_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(object)})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"allowed"}, reconciled)
+}
+
+func TestTiming(t *testing.T) {
+	f := Timing("test-timing")(func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		return nil, nil
+	})
+	for i := 0; i < 2; i++ {
+		_, err := f(context.Background(), nil, nil)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, testutil.CollectAndCount(functionDuration, "controllers_af_function_duration_seconds"))
+}
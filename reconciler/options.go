@@ -0,0 +1,216 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"time"
+
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Option configures the reconciler created by New.
+type Option func(r *reconciler)
+
+// WithMaxConcurrentPersists sets how many objects from Effects.Persists may be persisted at the same time.
+// Objects depending on each other are still persisted in dependency order. Default is 1 (sequential).
+func WithMaxConcurrentPersists(n int) Option {
+	return func(r *reconciler) {
+		if n < 1 {
+			n = 1
+		}
+		r.maxConcurrentPersists = n
+	}
+}
+
+// WithControllerReference makes the reconciler set the reconciled object as the controller owner of persisted objects
+// in its namespace (or of all persisted objects, if it is cluster-scoped). Objects that already have a controller
+// OwnerReference are left alone. GVK of the reconciled object is resolved using the client's scheme.
+func WithControllerReference() Option {
+	return func(r *reconciler) {
+		r.setControllerRef = true
+	}
+}
+
+// WithOwnerLabels makes the reconciler set owner labels and annotations (see OwnerLabel) on persisted objects that
+// cannot have an OwnerReference to the (namespaced) reconciled object: objects in other namespaces and cluster-scoped
+// objects. All such objects in Effects.Persists are considered owned by the reconciled object.
+//
+// When the reconciled object is found deleted, the reconciler deletes its labeled objects of `childTypes` (list types,
+// e.g. &rbacv1.ClusterRoleList{}). Use EnqueueRequestsForOwnerLabels to watch these objects.
+func WithOwnerLabels(childTypes ...client.ObjectList) Option {
+	return func(r *reconciler) {
+		r.ownerLabels = true
+		r.ownerLabelTypes = append(r.ownerLabelTypes, childTypes...)
+	}
+}
+
+// WithMaxPrunes sets the maximum number of objects that may be pruned (see function.Effects.Prune) in a single
+// reconcile. If more objects turn out to be stale, none of them is deleted and reconcile returns an error: this protects
+// from Function bugs that would otherwise wipe out all owned objects. Default is DefaultMaxPrunes.
+func WithMaxPrunes(n int) Option {
+	return func(r *reconciler) {
+		r.maxPrunes = n
+	}
+}
+
+// WithAPIReader provides a client.Reader reading directly from the API server, e.g. mgr.GetAPIReader(), and enables
+// read-your-writes consistency: the reconciler tracks objects it has written, and reads them (and lists of their type)
+// with the API reader until the (informer cache backed) client reflects these writes. The API reader also serves live
+// queries (see function.Query Live).
+func WithAPIReader(apiReader client.Reader) Option {
+	return func(r *reconciler) {
+		r.apiReader = apiReader
+		r.writes = newWriteTracker()
+	}
+}
+
+// WithDerivedWatches makes the reconciler track queries issued by the Function (via GetDetails) for each reconciled
+// object, and watch the queried types: a change to an object matching a query enqueues the reconciled objects that
+// issued it. Watches are started on the controller built by SetupWithManager.
+func WithDerivedWatches() Option {
+	return func(r *reconciler) {
+		r.dependencies = newDependencyIndex()
+	}
+}
+
+// WithPredicates sets predicates filtering events of reconciled objects, replacing DefaultPredicates. It is only
+// effective with SetupWithManager. Calling it with no arguments disables filtering.
+func WithPredicates(predicates ...predicate.Predicate) Option {
+	return func(r *reconciler) {
+		r.predicates = predicates
+	}
+}
+
+// WithClusters provides the registry of clusters that queries and effects of the Function may target (see
+// function.Query Cluster and function.Effects Clusters). Cluster clients should use the reconciler client's scheme.
+//
+// Objects persisted in other clusters get owner labels and annotations (see OwnerLabel) pointing to the reconciled
+// object. To enqueue it on changes to these objects, watch them with EnqueueRequestsForOwnerLabels, e.g. with
+// a controller-runtime cluster.Cluster `workload`:
+//
+//  bldr.Watches(source.NewKindWithCache(&corev1.ConfigMap{}, workload.GetCache()),
+//  	reconciler.EnqueueRequestsForOwnerLabels(mgr.GetClient(), log, &v1alpha1.Primary{}))
+//
+// Objects in other clusters are not deleted when the reconciled object is: use a finalizer to clean them up.
+func WithClusters(registry ClusterRegistry) Option {
+	return func(r *reconciler) {
+		r.clusters = registry
+	}
+}
+
+// WithMiddleware wraps the Function with middlewares (e.g. Logging, Timing or NamespaceAllowlist): the first one is the
+// outermost.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(r *reconciler) {
+		r.middlewares = append(r.middlewares, middlewares...)
+	}
+}
+
+// WithPauseAnnotation sets the annotation pausing reconciliation of objects having it set to "true" (default is
+// PausedAnnotation). An empty annotation disables pausing.
+func WithPauseAnnotation(annotation string) Option {
+	return func(r *reconciler) {
+		r.pauseAnnotation = annotation
+	}
+}
+
+// WithEventRecorder provides the recorder for events on reconciled objects (e.g. mgr.GetEventRecorderFor(name)):
+// Paused and Resumed (see PausedAnnotation).
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(r *reconciler) {
+		r.recorder = recorder
+	}
+}
+
+// WithTimeout sets the time budget of a whole reconcile: its context is cancelled after the timeout, and failures
+// after that are reported as TimeoutError of ReconcilePhase. Default is 0 (no timeout).
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *reconciler) {
+		r.timeout = timeout
+	}
+}
+
+// WithFunctionTimeout sets the time budget of the Function call: its context is cancelled after the timeout (which
+// fails further queries), and failures after that are reported as TimeoutError of FunctionPhase. The Function can't be
+// interrupted otherwise: it should respect its context. Default is 0 (no timeout).
+func WithFunctionTimeout(timeout time.Duration) Option {
+	return func(r *reconciler) {
+		r.functionTimeout = timeout
+	}
+}
+
+// WithApplyTimeout sets the time budget of applying the effects: failures after the timeout are reported as
+// TimeoutError of ApplyPhase. Default is 0 (no timeout).
+func WithApplyTimeout(timeout time.Duration) Option {
+	return func(r *reconciler) {
+		r.applyTimeout = timeout
+	}
+}
+
+// WithSoftDeadline sets a soft deadline of the Function: `after` its call. The Function can see it with
+// function.SoftDeadline, and use it to return (e.g. with Effects done so far) before the hard deadline (see
+// WithFunctionTimeout and WithTimeout).
+func WithSoftDeadline(after time.Duration) Option {
+	return func(r *reconciler) {
+		r.softDeadline = after
+	}
+}
+
+// WithCrashOnPanic makes the reconciler re-panic on panics (other than errors of GetDetails queries) instead of
+// recovering them into PanicError: e.g. to fail tests fast.
+func WithCrashOnPanic() Option {
+	return func(r *reconciler) {
+		r.crashOnPanic = true
+	}
+}
+
+// WithoutStatusOptimisticLock makes status patches of persisted objects skip the resourceVersion precondition: status
+// writes then don't fail with conflicts on concurrent updates of the object (e.g. its spec by a user).
+func WithoutStatusOptimisticLock() Option {
+	return func(r *reconciler) {
+		r.statusOptimisticLock = false
+	}
+}
+
+// WithObservedGeneration makes the reconciler set status.observedGeneration of the reconciled object, when it is in
+// Effects.Persists, to the generation of the reconciled object passed to the Function. Typed objects should have
+// a Status struct with an int64 ObservedGeneration field, unstructured objects should have a status.
+func WithObservedGeneration() Option {
+	return func(r *reconciler) {
+		r.observedGeneration = true
+	}
+}
+
+// WithDriftDetection makes the reconciler report persisted objects changed (e.g. hand-edited by users) since it last
+// applied them, before patching them back: with the controllers_af_drifts_total metric, a Drifted event (see
+// WithEventRecorder) and the handlers. The reconciler records the applied desired state in LastAppliedAnnotation of
+// persisted objects; objects without it are not checked until they have it. The reconciled object itself is not
+// checked. Drifted fields are those applied and
+// changed since, and those added since (outside metadata and status, except labels and annotations) which the patch
+// would remove: including fields defaulted by the API server or set by other controllers, if the desired state
+// doesn't set them.
+//
+// Fields users are allowed to change can be listed in DriftIgnoreAnnotation on the object (honored with or without
+// drift detection).
+func WithDriftDetection(handlers ...DriftHandler) Option {
+	return func(r *reconciler) {
+		r.driftDetection = true
+		r.driftHandlers = append(r.driftHandlers, handlers...)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Owner labels and annotations are set on objects that cannot have an OwnerReference to the reconciled object: those in
+// other namespaces and cluster-scoped ones (see WithOwnerLabels).
+const (
+	// OwnerLabel is set to a hash of the owner's kind, namespace and name: it allows listing objects of an owner, even
+	// after the owner has been deleted.
+	OwnerLabel = "controllers-af.io/owner"
+
+	OwnerKindAnnotation      = "controllers-af.io/owner-kind"
+	OwnerNamespaceAnnotation = "controllers-af.io/owner-namespace"
+	OwnerNameAnnotation      = "controllers-af.io/owner-name"
+)
+
+// EnqueueRequestsForOwnerLabels creates a handler.EventHandler enqueuing owners (of `ownerType`) of objects persisted
+// with owner labels and annotations. It is the WithOwnerLabels counterpart of handler.EnqueueRequestForOwner.
+func EnqueueRequestsForOwnerLabels(c client.Client, log logr.Logger, ownerType client.Object) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
+		ownerGK, err := groupKind(c, ownerType)
+		if err != nil {
+			log.Error(err, "resolving owner GroupKind", "ownerType", ownerType)
+			return nil
+		}
+		owner, isOwned := labeledOwner(ownerGK, object)
+		if !isOwned {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: owner}}
+	})
+}
+
+func labeledOwner(ownerGK schema.GroupKind, object client.Object) (types.NamespacedName, bool) {
+	annotations := object.GetAnnotations()
+	owner := types.NamespacedName{
+		Namespace: annotations[OwnerNamespaceAnnotation],
+		Name:      annotations[OwnerNameAnnotation],
+	}
+	if annotations[OwnerKindAnnotation] != ownerGK.String() || owner.Name == "" {
+		return types.NamespacedName{}, false
+	}
+	if object.GetLabels()[OwnerLabel] != ownerLabelValue(ownerGK, owner) {
+		return types.NamespacedName{}, false
+	}
+	return owner, true
+}
+
+func ownerLabelValue(ownerGK schema.GroupKind, owner types.NamespacedName) string {
+	sum := sha1.Sum([]byte(ownerGK.String() + "/" + owner.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func groupKind(c client.Client, object client.Object) (schema.GroupKind, error) {
+	gvk, err := apiutil.GVKForObject(object, c.Scheme())
+	if err != nil {
+		return schema.GroupKind{}, err
+	}
+	return gvk.GroupKind(), nil
+}
+
+func (r *reconciler) setOwnerLabels(owner client.Object, objects []client.Object) error {
+	if owner.GetNamespace() == "" && !r.remote {
+		return nil // cluster-scoped owners can have OwnerReferences from any object (in the same cluster)
+	}
+	ownerGK, err := groupKind(r.client, owner)
+	if err != nil {
+		return err
+	}
+	ownerName := client.ObjectKeyFromObject(owner)
+
+	for _, object := range objects {
+		if !r.remote && (sameObject(r.client.Scheme(), object, owner) || object.GetNamespace() == owner.GetNamespace()) {
+			continue
+		}
+		labels := make(map[string]string, len(object.GetLabels())+1)
+		for k, v := range object.GetLabels() {
+			labels[k] = v
+		}
+		labels[OwnerLabel] = ownerLabelValue(ownerGK, ownerName)
+		object.SetLabels(labels)
+
+		annotations := make(map[string]string, len(object.GetAnnotations())+3)
+		for k, v := range object.GetAnnotations() {
+			annotations[k] = v
+		}
+		annotations[OwnerKindAnnotation] = ownerGK.String()
+		annotations[OwnerNamespaceAnnotation] = ownerName.Namespace
+		annotations[OwnerNameAnnotation] = ownerName.Name
+		object.SetAnnotations(annotations)
+	}
+	return nil
+}
+
+// deleteLabeledChildren deletes objects with owner labels pointing to the (deleted) reconciled object.
+func (r *reconciler) deleteLabeledChildren(ctx context.Context, ownerName types.NamespacedName) error {
+	if len(r.ownerLabelTypes) == 0 {
+		return nil
+	}
+	ownerGK, err := groupKind(r.client, r.objType)
+	if err != nil {
+		return err
+	}
+	selector := client.MatchingLabels{OwnerLabel: ownerLabelValue(ownerGK, ownerName)}
+
+	for _, childType := range r.ownerLabelTypes {
+		list := childType.DeepCopyObject().(client.ObjectList)
+		if err := r.client.List(ctx, list, selector); err != nil {
+			return errors.Wrapf(err, "listing %T owned by %s %s", list, ownerGK, ownerName)
+		}
+		if err := meta.EachListItem(list, func(item runtime.Object) error {
+			child := item.(client.Object)
+			if _, isOwned := labeledOwner(ownerGK, child); !isOwned {
+				return nil
+			}
+			if err := r.client.Delete(ctx, child); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			r.trackWrite(child, true)
+			written(ctx, child, "deleted")
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestReconcileWithOwnerLabels(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, object client.Object, _ function.GetDetails) (*function.Effects, error) {
+		return &function.Effects{Persists: []client.Object{
+			object,
+			configMap("ns", "sibling"),
+			configMap("other-ns", "elsewhere"),
+			&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "cluster-wide"}},
+		}}, nil
+	}, WithOwnerLabels(&corev1.ConfigMapList{}, &rbacv1.ClusterRoleList{}))
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+
+	sibling, elsewhere, clusterRole := &corev1.ConfigMap{}, &corev1.ConfigMap{}, &rbacv1.ClusterRole{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "sibling"}, sibling))
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "other-ns", Name: "elsewhere"}, elsewhere))
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Name: "cluster-wide"}, clusterRole))
+
+	assert.NotContains(t, sibling.Labels, OwnerLabel)
+	configMapGK := schema.GroupKind{Kind: "ConfigMap"}
+	for _, child := range []client.Object{elsewhere, clusterRole} {
+		owner, isOwned := labeledOwner(configMapGK, child)
+		assert.True(t, isOwned)
+		assert.Equal(t, request.NamespacedName, owner)
+	}
+
+	require.NoError(t, cl.Delete(context.Background(), primary))
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+
+	assert.True(t, apierrors.IsNotFound(cl.Get(context.Background(), client.ObjectKey{Namespace: "other-ns", Name: "elsewhere"}, elsewhere)))
+	assert.True(t, apierrors.IsNotFound(cl.Get(context.Background(), client.ObjectKey{Name: "cluster-wide"}, clusterRole)))
+	assert.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "sibling"}, sibling))
+}
+
+func TestLabeledOwnerOfOtherKind(t *testing.T) {
+	child := configMap("other-ns", "child")
+	child.Labels = map[string]string{OwnerLabel: ownerLabelValue(schema.GroupKind{Kind: "Secret"}, types.NamespacedName{Namespace: "ns", Name: "owner"})}
+	child.Annotations = map[string]string{
+		OwnerKindAnnotation:      "Secret",
+		OwnerNamespaceAnnotation: "ns",
+		OwnerNameAnnotation:      "owner",
+	}
+
+	_, isOwned := labeledOwner(schema.GroupKind{Kind: "ConfigMap"}, child)
+	assert.False(t, isOwned)
+	owner, isOwned := labeledOwner(schema.GroupKind{Kind: "Secret"}, child)
+	assert.True(t, isOwned)
+	assert.Equal(t, types.NamespacedName{Namespace: "ns", Name: "owner"}, owner)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/go-logr/logr"
+)
+
+// queryPanic carries the error of a query: GetDetails panics with it, to be recovered (as the error) by the reconciler.
+// It is an error itself, wrapping the query error, for code recovering GetDetails panics as errors.
+type queryPanic struct {
+	err error
+}
+
+func (p queryPanic) Error() string {
+	return p.err.Error()
+}
+
+func (p queryPanic) Unwrap() error {
+	return p.err
+}
+
+func (p queryPanic) Cause() error {
+	return p.err
+}
+
+// PanicError is a recovered panic: e.g. in a Function. Print it with %+v to see the stack trace.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value, if it's an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+func (e *PanicError) Format(s fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && s.Flag('+'):
+		_, _ = fmt.Fprintf(s, "%s\n%s", e.Error(), e.Stack)
+	case verb == 'q':
+		_, _ = fmt.Fprintf(s, "%q", e.Error())
+	default:
+		_, _ = io.WriteString(s, e.Error())
+	}
+}
+
+// recoverPanic converts a value recovered from a panic (if any) into the error to return instead of `orig`: errors of
+// GetDetails queries are returned as is, other panics are logged and counted (under `source`) as PanicError.
+func recoverPanic(v interface{}, orig error, log logr.Logger, source string) error {
+	if v == nil {
+		return orig
+	}
+	if p, isQueryPanic := v.(queryPanic); isQueryPanic {
+		return p.err
+	}
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	panics.WithLabelValues(source).Inc()
+	log.Error(err, "recovered panic", "stack", string(err.Stack))
+	return err
+}
+
+// panicErr recovers a panic in Reconcile (see recoverPanic), unless the reconciler is set to crash on panics.
+func (r *reconciler) panicErr(log logr.Logger, v interface{}, orig error) error {
+	if r.crashOnPanic {
+		if _, isQueryPanic := v.(queryPanic); v != nil && !isQueryPanic {
+			panic(v)
+		}
+	}
+	return recoverPanic(v, orig, log, "reconcile")
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestReconcileRecoversPanics(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+
+	for _, f := range []Function{
+		func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+			var m map[string]string
+			m["key"] = "value"
+			return nil, nil
+		},
+		func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+			panic("not an error")
+		},
+	} {
+		before := testutil.ToFloat64(panics.WithLabelValues("reconcile"))
+		_, err := New(cl, logr.Discard(), &corev1.ConfigMap{}, f).Reconcile(context.Background(), request)
+		require.IsType(t, &PanicError{}, err)
+		assert.Contains(t, string(err.(*PanicError).Stack), "panics_test.go")
+		assert.Contains(t, fmt.Sprintf("%+v", err), "panics_test.go")
+		assert.NotContains(t, err.Error(), "panics_test.go")
+		assert.Equal(t, before+1, testutil.ToFloat64(panics.WithLabelValues("reconcile")))
+
+		assert.Panics(t, func() {
+			_, _ = New(cl, logr.Discard(), &corev1.ConfigMap{}, f, WithCrashOnPanic()).Reconcile(context.Background(), request)
+		})
+	}
+
+	_, err := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		getDetails(function.Query{Type: &corev1.ConfigMap{}, Namespace: "ns"}) // not a list type
+		return nil, nil
+	}, WithCrashOnPanic()).Reconcile(context.Background(), request)
+	assert.Error(t, err, "query errors are returned, even with WithCrashOnPanic")
+	_, isPanic := err.(*PanicError)
+	assert.False(t, isPanic)
+}
+
+func TestEnqueueRecoversPanics(t *testing.T) {
+	cl := newFakeClient()
+	h := EnqueueRequestsForQuery(cl, logr.Discard(), func(client.Object) function.Query {
+		panic("not an error")
+	})
+	q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	before := testutil.ToFloat64(panics.WithLabelValues("query"))
+	h.Create(event.CreateEvent{Object: configMap("ns", "cm")}, q)
+	assert.Empty(t, queued(q))
+	assert.Equal(t, before+1, testutil.ToFloat64(panics.WithLabelValues("query")))
+}
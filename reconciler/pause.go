@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PausedAnnotation set to "true" on a reconciled object pauses its reconciliation (see WithPauseAnnotation): the
+// Function isn't called, and no effects are applied, until the annotation is removed (or set to another value).
+const PausedAnnotation = "controllers-af.io/paused"
+
+// pausedObjects remembers reconciled objects found paused, to tell when they are resumed.
+type pausedObjects struct {
+	sync.Mutex
+	objects map[types.NamespacedName]bool
+}
+
+// set records whether the object is paused, and returns whether it was before.
+func (p *pausedObjects) set(name types.NamespacedName, paused bool) bool {
+	p.Lock()
+	defer p.Unlock()
+	wasPaused := p.objects[name]
+	if paused {
+		if p.objects == nil {
+			p.objects = map[types.NamespacedName]bool{}
+		}
+		p.objects[name] = true
+	} else {
+		delete(p.objects, name)
+	}
+	return wasPaused
+}
+
+func (r *reconciler) isPaused(object client.Object) bool {
+	return r.pauseAnnotation != "" && object.GetAnnotations()[r.pauseAnnotation] == "true"
+}
+
+// updatePaused records whether the object is paused, and reports it being paused or resumed with a log message and
+// an event (see WithEventRecorder).
+func (r *reconciler) updatePaused(ctx context.Context, object client.Object, paused bool) {
+	log := logr.FromContextOrDiscard(ctx)
+	wasPaused := r.paused.set(client.ObjectKeyFromObject(object), paused)
+	switch {
+	case paused && !wasPaused:
+		log.Info("reconciliation paused", "annotation", r.pauseAnnotation)
+		r.event(object, corev1.EventTypeNormal, "Paused", "Reconciliation paused by annotation %s", r.pauseAnnotation)
+	case !paused && wasPaused:
+		log.Info("reconciliation resumed")
+		r.event(object, corev1.EventTypeNormal, "Resumed", "Reconciliation resumed")
+	}
+}
+
+func (r *reconciler) event(object client.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.recorder != nil {
+		r.recorder.Eventf(object, eventType, reason, messageFmt, args...)
+	}
+}
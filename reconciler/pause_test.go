@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestReconcilePaused(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	primary.Annotations = map[string]string{PausedAnnotation: "true"}
+	cl := newFakeClient(primary)
+	recorder := record.NewFakeRecorder(10)
+
+	calls := 0
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		calls++
+		return &function.Effects{Persists: []client.Object{configMap("ns", "child")}}, nil
+	}, WithEventRecorder(recorder))
+
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	for i := 0; i < 2; i++ {
+		_, err := r.Reconcile(context.Background(), request)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, calls)
+	assert.True(t, apierrors.IsNotFound(cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, &corev1.ConfigMap{})))
+	assert.Equal(t, []string{"Normal Paused Reconciliation paused by annotation " + PausedAnnotation}, events(recorder))
+
+	require.NoError(t, cl.Get(context.Background(), request.NamespacedName, primary))
+	primary.Annotations = nil
+	require.NoError(t, cl.Update(context.Background(), primary))
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "child"}, &corev1.ConfigMap{}))
+	assert.Equal(t, []string{"Normal Resumed Reconciliation resumed"}, events(recorder))
+}
+
+func TestReconcilePausedDeleted(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.Annotations = map[string]string{PausedAnnotation: "true"}
+	cl := newFakeClient(primary.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		return nil, nil
+	}, WithEventRecorder(recorder))
+
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Normal Paused Reconciliation paused by annotation " + PausedAnnotation}, events(recorder))
+
+	require.NoError(t, cl.Delete(context.Background(), primary.DeepCopy()))
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Empty(t, r.paused.objects)
+
+	// re-created with the same name, still paused
+	require.NoError(t, cl.Create(context.Background(), primary.DeepCopy()))
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Normal Paused Reconciliation paused by annotation " + PausedAnnotation}, events(recorder))
+}
+
+func TestReconcileWithoutPauseAnnotation(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.Annotations = map[string]string{PausedAnnotation: "true"}
+	cl := newFakeClient(primary)
+
+	calls := 0
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		calls++
+		return nil, nil
+	}, WithPauseAnnotation(""))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// DefaultPredicates returns predicates applied by SetupWithManager to events of reconciled objects, unless set with
+// WithPredicates: updates are only let through if generation or labels have changed. Status updates (and
+// metadata-only updates, like managedFields or resourceVersion) don't change generation of objects with a status
+// subresource.
+//
+// Objects that don't have generation (e.g. ConfigMaps) should use other predicates, like IgnoreStatusUpdates().
+func DefaultPredicates() []predicate.Predicate {
+	return []predicate.Predicate{GenerationOrLabelsChanged()}
+}
+
+// GenerationOrLabelsChanged returns a predicate letting through updates changing either generation or labels.
+func GenerationOrLabelsChanged() predicate.Predicate {
+	return predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{})
+}
+
+// AnnotationChanged returns a predicate letting through updates changing the annotation. Other events are filtered out:
+// combine it with predicate.Or.
+func AnnotationChanged(annotation string) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return true
+			}
+			oldValue, oldExists := e.ObjectOld.GetAnnotations()[annotation]
+			newValue, newExists := e.ObjectNew.GetAnnotations()[annotation]
+			return oldExists != newExists || oldValue != newValue
+		},
+	}
+}
+
+// IgnoreStatusUpdates returns a predicate ignoring updates that only change status, managedFields or resourceVersion.
+func IgnoreStatusUpdates() predicate.Predicate {
+	return IgnoreFieldUpdates("status", "metadata.managedFields", "metadata.resourceVersion")
+}
+
+// IgnoreFieldUpdates returns a predicate ignoring updates that only change the given fields: dot-separated paths, e.g.
+// "status" or "metadata.annotations.example\.org/ignored" (dots in field names are escaped with a backslash). Use it
+// to ignore updates of fields your Function doesn't read.
+func IgnoreFieldUpdates(fields ...string) predicate.Predicate {
+	paths := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		paths = append(paths, fieldPath(field))
+	}
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return true
+			}
+			oldContent, err := withoutFields(e.ObjectOld, paths)
+			if err != nil {
+				return true
+			}
+			newContent, err := withoutFields(e.ObjectNew, paths)
+			if err != nil {
+				return true
+			}
+			return !reflect.DeepEqual(oldContent, newContent)
+		},
+	}
+}
+
+func fieldPath(field string) []string {
+	var path []string
+	var current strings.Builder
+	escaped := false
+	for _, c := range field {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			path = append(path, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	return append(path, current.String())
+}
+
+func withoutFields(object runtime.Object, paths [][]string) (map[string]interface{}, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		unstructured.RemoveNestedField(content, path...)
+	}
+	return content, nil
+}
+
+// forPrimary applies the predicate only to events of reconciled (primary) objects, letting other events through.
+type forPrimary struct {
+	predicate.Predicate
+	scheme *runtime.Scheme
+	gvk    schema.GroupVersionKind
+}
+
+func (p forPrimary) isPrimary(object client.Object) bool {
+	gvk, err := apiutil.GVKForObject(object, p.scheme)
+	return err == nil && gvk == p.gvk
+}
+
+func (p forPrimary) Create(e event.CreateEvent) bool {
+	return !p.isPrimary(e.Object) || p.Predicate.Create(e)
+}
+
+func (p forPrimary) Update(e event.UpdateEvent) bool {
+	return !p.isPrimary(e.ObjectNew) || p.Predicate.Update(e)
+}
+
+func (p forPrimary) Delete(e event.DeleteEvent) bool {
+	return !p.isPrimary(e.Object) || p.Predicate.Delete(e)
+}
+
+func (p forPrimary) Generic(e event.GenericEvent) bool {
+	return !p.isPrimary(e.Object) || p.Predicate.Generic(e)
+}
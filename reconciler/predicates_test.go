@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+func TestIgnoreStatusUpdates(t *testing.T) {
+	old := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", ResourceVersion: "1"}}
+	p := IgnoreStatusUpdates()
+
+	statusUpdate := old.DeepCopy()
+	statusUpdate.ResourceVersion = "2"
+	statusUpdate.Status.Replicas = 1
+	statusUpdate.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "controller"}}
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: statusUpdate}))
+
+	specUpdate := statusUpdate.DeepCopy()
+	specUpdate.Spec.Replicas = pointer.Int32Ptr(2)
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: specUpdate}))
+}
+
+func TestIgnoreFieldUpdates(t *testing.T) {
+	old := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{"example.org/ignored": "1"}}}
+	p := IgnoreFieldUpdates(`metadata.annotations.example\.org/ignored`)
+
+	updated := old.DeepCopy()
+	updated.Annotations["example.org/ignored"] = "2"
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}))
+
+	updated.Annotations["example.org/other"] = "1"
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}))
+}
+
+func TestAnnotationChanged(t *testing.T) {
+	old := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+	p := AnnotationChanged(PausedAnnotation)
+
+	updated := old.DeepCopy()
+	updated.Annotations = map[string]string{"example.org/other": "1"}
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}))
+
+	paused := updated.DeepCopy()
+	paused.Annotations[PausedAnnotation] = "true"
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: updated, ObjectNew: paused}))
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: paused, ObjectNew: updated}))
+}
+
+func TestPrimaryPredicate(t *testing.T) {
+	inNamespaceA := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == "a"
+	})
+	r := New(newFakeClient(), logr.Discard(), &corev1.ConfigMap{}, nil, WithPredicates(inNamespaceA))
+	p := r.primaryPredicate()
+
+	assert.True(t, p.Create(event.CreateEvent{Object: configMap("a", "cm")}))
+	assert.False(t, p.Create(event.CreateEvent{Object: configMap("b", "cm")}))
+	assert.False(t, p.Delete(event.DeleteEvent{Object: configMap("b", "cm")}))
+	assert.False(t, p.Generic(event.GenericEvent{Object: configMap("b", "cm")}))
+
+	paused := configMap("b", "cm")
+	paused.Annotations = map[string]string{PausedAnnotation: "true"}
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: configMap("b", "cm"), ObjectNew: configMap("b", "cm")}))
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: configMap("b", "cm"), ObjectNew: paused}))
+}
+
+func TestForPrimary(t *testing.T) {
+	gvk := appsv1.SchemeGroupVersion.WithKind("Deployment")
+	p := forPrimary{Predicate: predicate.Funcs{UpdateFunc: func(event.UpdateEvent) bool { return false }}, scheme: clientgoscheme.Scheme, gvk: gvk}
+
+	deployment := &appsv1.Deployment{}
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: deployment, ObjectNew: deployment}))
+	cm := configMap("ns", "cm")
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: cm, ObjectNew: cm}))
+}
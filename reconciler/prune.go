@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultMaxPrunes is the default maximum number of objects pruned in a single reconcile (see WithMaxPrunes).
+const DefaultMaxPrunes = 100
+
+// prune deletes objects of `listTypes` owned by `owner`, except those in `desired` (already persisted, so having UIDs).
+func (r *reconciler) prune(ctx context.Context, owner client.Object, listTypes []client.ObjectList, desired []client.Object) error {
+	if len(listTypes) == 0 {
+		return nil
+	}
+
+	keep := make(map[types.UID]bool, len(desired))
+	for _, object := range desired {
+		keep[object.GetUID()] = true
+	}
+
+	var stale []client.Object
+	for _, listType := range listTypes {
+		owned, err := r.listOwned(ctx, owner, listType)
+		if err != nil {
+			return err
+		}
+		for _, object := range owned {
+			if !keep[object.GetUID()] {
+				stale = append(stale, object)
+			}
+		}
+	}
+
+	if len(stale) > r.maxPrunes {
+		return errors.Errorf("refusing to prune %d objects owned by %s/%s: more than %d allowed in a single reconcile", len(stale), owner.GetNamespace(), owner.GetName(), r.maxPrunes)
+	}
+	for _, object := range stale {
+		if err := r.client.Delete(ctx, object); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		r.trackWrite(object, true)
+		written(ctx, object, "deleted")
+	}
+	return nil
+}
+
+// listOwned lists objects of `listType` controlled by `owner` via OwnerReferences or (if enabled) owner labels.
+func (r *reconciler) listOwned(ctx context.Context, owner client.Object, listType client.ObjectList) ([]client.Object, error) {
+	var owned []client.Object
+	seen := map[types.UID]bool{}
+	collect := func(list client.ObjectList, isOwned func(object client.Object) bool) error {
+		return meta.EachListItem(list, func(item runtime.Object) error {
+			object := item.(client.Object)
+			if !seen[object.GetUID()] && isOwned(object) {
+				seen[object.GetUID()] = true
+				owned = append(owned, object)
+			}
+			return nil
+		})
+	}
+
+	if !r.remote {
+		list := listType.DeepCopyObject().(client.ObjectList)
+		if err := r.client.List(ctx, list, client.InNamespace(owner.GetNamespace())); err != nil {
+			return nil, errors.Wrapf(err, "listing %T to prune", list)
+		}
+		if err := collect(list, func(object client.Object) bool {
+			return v1.IsControlledBy(object, owner)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.ownerLabels && (owner.GetNamespace() != "" || r.remote) {
+		ownerGK, err := groupKind(r.client, owner)
+		if err != nil {
+			return nil, err
+		}
+		ownerName := client.ObjectKeyFromObject(owner)
+		list := listType.DeepCopyObject().(client.ObjectList)
+		if err := r.client.List(ctx, list, client.MatchingLabels{OwnerLabel: ownerLabelValue(ownerGK, ownerName)}); err != nil {
+			return nil, errors.Wrapf(err, "listing %T to prune", list)
+		}
+		if err := collect(list, func(object client.Object) bool {
+			labeledOwnerName, isOwned := labeledOwner(ownerGK, object)
+			return isOwned && labeledOwnerName == ownerName
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return owned, nil
+}
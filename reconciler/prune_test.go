@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func ownedConfigMap(owner client.Object, namespace, name string) *corev1.ConfigMap {
+	cm := configMap(namespace, name)
+	cm.UID = types.UID(name + "-uid")
+	cm.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       owner.GetName(),
+		UID:        owner.GetUID(),
+		Controller: pointer.BoolPtr(true),
+	}}
+	return cm
+}
+
+func TestReconcilePrune(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	wanted, stale, unrelated := ownedConfigMap(primary, "ns", "wanted"), ownedConfigMap(primary, "ns", "stale"), configMap("ns", "unrelated")
+	cl := newFakeClient(primary, wanted, stale, unrelated)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		wanted := ownedConfigMap(primary, "ns", "wanted")
+		wanted.UID = "" // not fetched by the Function
+		return &function.Effects{
+			Persists: []client.Object{wanted, configMap("other-ns", "labeled")},
+			Prune:    []client.ObjectList{&corev1.ConfigMapList{}},
+		}, nil
+	}, WithOwnerLabels())
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+
+	exists := func(namespace, name string) bool {
+		err := cl.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, &corev1.ConfigMap{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+	assert.True(t, exists("ns", "primary"))
+	assert.True(t, exists("ns", "wanted"))
+	assert.False(t, exists("ns", "stale"))
+	assert.True(t, exists("ns", "unrelated"))
+	assert.True(t, exists("other-ns", "labeled"))
+
+	r.f = func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		return &function.Effects{Prune: []client.ObjectList{&corev1.ConfigMapList{}}}, nil
+	}
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.False(t, exists("ns", "wanted"))
+	assert.False(t, exists("other-ns", "labeled"))
+	assert.True(t, exists("ns", "unrelated"))
+}
+
+func TestReconcilePruneCap(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary, ownedConfigMap(primary, "ns", "stale1"), ownedConfigMap(primary, "ns", "stale2"))
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		return &function.Effects{Prune: []client.ObjectList{&corev1.ConfigMapList{}}}, nil
+	}, WithMaxPrunes(1))
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	assert.Error(t, err)
+
+	list := &corev1.ConfigMapList{}
+	require.NoError(t, cl.List(context.Background(), list))
+	assert.Len(t, list.Items, 3)
+}
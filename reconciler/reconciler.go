@@ -19,17 +19,27 @@ package reconciler
 import (
 	"context"
 	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/imikushin/controllers-af/function"
@@ -40,13 +50,26 @@ type Function func(ctx context.Context, object client.Object, getDetails functio
 
 // New creates a reconcile.Reconciler for your object type and Function.
 // `objType` should be an empty client.Object instance.
-func New(cl client.Client, logger logr.Logger, objType client.Object, f Function) *reconciler {
-	return &reconciler{
+func New(cl client.Client, logger logr.Logger, objType client.Object, f Function, opts ...Option) *reconciler {
+	r := &reconciler{
 		client:  cl,
 		logger:  logger,
 		objType: objType.DeepCopyObject().(client.Object),
 		f:       f,
+
+		maxConcurrentPersists: 1,
+		maxPrunes:             DefaultMaxPrunes,
+		predicates:            DefaultPredicates(),
+		pauseAnnotation:       PausedAnnotation,
+		statusOptimisticLock:  true,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		r.f = r.middlewares[i](r.f)
 	}
+	return r
 }
 
 type reconciler struct {
@@ -54,96 +77,250 @@ type reconciler struct {
 	logger  logr.Logger
 	objType client.Object
 	f       Function
+
+	maxConcurrentPersists int
+	setControllerRef      bool
+	ownerLabels           bool
+	ownerLabelTypes       []client.ObjectList
+	maxPrunes             int
+	apiReader             client.Reader
+	writes                *writeTracker
+	dependencies          *dependencyIndex
+	watches               watchStarter
+	predicates            []predicate.Predicate
+	crashOnPanic          bool
+	clusters              ClusterRegistry
+	middlewares           []Middleware
+	pauseAnnotation       string
+	paused                pausedObjects
+	recorder              record.EventRecorder
+	timeout               time.Duration
+	functionTimeout       time.Duration
+	applyTimeout          time.Duration
+	softDeadline          time.Duration
+	statusOptimisticLock  bool
+	observedGeneration    bool
+	driftDetection        bool
+	driftHandlers         []DriftHandler
+
+	// remote is set for reconcilers applying effects in other clusters (see inCluster): all persisted objects get owner
+	// labels, as OwnerReferences can't point across clusters.
+	remote bool
 }
 
 // EnqueueRequestsForQuery allows to create a handler.EventHandler by providing a function.ObjectToQuery function.
 // It is kind of like a handler.EnqueueRequestsFromMapFunc, but without the boring parts :)
-func EnqueueRequestsForQuery(c client.Client, log logr.Logger, toQuery function.ObjectToQuery) handler.EventHandler {
-	return handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
-		query := toQuery(object)
-
-		cache := cache{}
-		if _, err := runQuery(context.Background(), c, cache, query); err != nil {
-			log.Error(err, "running query to enqueue objects", "query", query)
-			return nil
-		}
-
-		result := make([]reconcile.Request, 0, len(cache))
-		for _, v := range cache {
-			result = append(result, reconcile.Request{NamespacedName: types.NamespacedName{
-				Namespace: v.GetNamespace(),
-				Name:      v.GetName(),
-			}})
-		}
-		return result
-	})
+func EnqueueRequestsForQuery(c client.Client, log logr.Logger, toQuery function.ObjectToQuery, opts ...EnqueueOption) handler.EventHandler {
+	return &enqueuer{
+		name: "query",
+		log:  log,
+		opts: newEnqueueOptions(opts),
+		mapFunc: func(ctx context.Context, objects ...client.Object) ([]reconcile.Request, error) {
+			var result []reconcile.Request
+			for _, object := range objects {
+				query := toQuery(object)
+				found, err := queryObjects(ctx, c, query)
+				if err != nil {
+					return nil, errors.Wrapf(err, "running query %+v", query)
+				}
+				for _, v := range found {
+					result = append(result, reconcile.Request{NamespacedName: types.NamespacedName{
+						Namespace: v.GetNamespace(),
+						Name:      v.GetName(),
+					}})
+				}
+			}
+			return result, nil
+		},
+	}
 }
 
 func (r *reconciler) Reconcile(ctx context.Context, request reconcile.Request) (retRes reconcile.Result, retErr error) {
-	ctx, cancel := context.WithCancel(ctx)
+	start := time.Now()
+	log := r.requestLogger(request)
+	ctx = logr.NewContext(ctx, log)
+	ctx, stats := withStats(ctx)
+	queries := &queryLog{}
+	defer func() {
+		logSummary(log, start, queries, stats, retErr)
+	}()
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
 	defer cancel()
 
 	obj := r.objType.DeepCopyObject().(client.Object)
-	if err := r.client.Get(ctx, request.NamespacedName, obj); err != nil {
+	if err := r.reader(ctx, obj, request.Namespace, request.Name).Get(ctx, request.NamespacedName, obj); err != nil {
 		if apierrors.IsNotFound(err) {
-			return reconcile.Result{}, nil
+			if r.dependencies != nil {
+				r.dependencies.forget(request.NamespacedName)
+			}
+			r.paused.set(request.NamespacedName, false)
+			return reconcile.Result{}, r.deleteLabeledChildren(ctx, request.NamespacedName)
 		}
 		return reconcile.Result{}, err
 	}
 
-	cache := cache{obj.GetUID(): obj.DeepCopyObject().(client.Object)}
+	paused := r.isPaused(obj)
+	r.updatePaused(ctx, obj, paused)
+	if paused {
+		return reconcile.Result{}, nil
+	}
+
+	caches := clusterCaches{"": {obj.GetUID(): obj.DeepCopyObject().(client.Object)}}
+	if r.dependencies != nil {
+		defer r.updateDependencies(request.NamespacedName, queries)
+	}
 
 	defer func() {
-		retErr = panicErr(recover(), retErr)
+		retErr = r.panicErr(log, recover(), retErr)
 	}()
-	effects, err := r.f(ctx, obj, r.getDetails(ctx, cache)) // r.getDetails() panic-wraps an error
-	if err != nil || effects == nil {
+	ctx, applied := withAppliedCallbacks(ctx)
+	effects, err := r.callFunction(ctx, obj, caches, queries)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	if err := r.persistObjects(ctx, cache, effects.Persists); err != nil {
-		return reconcile.Result{}, err
-	}
-	if err := r.deleteObjects(ctx, effects.Deletes); err != nil {
-		return reconcile.Result{}, err
+	applyCtx, cancelApply := withTimeout(ctx, r.applyTimeout)
+	defer cancelApply()
+	err = r.timeoutErr(ctx, applyCtx, ApplyPhase, r.applyTimeout, r.applyAll(applyCtx, obj, caches, effects))
+	applied.call(ctx, err)
+	return reconcile.Result{}, err
+}
+
+// callFunction calls the Function with its time budget (and soft deadline, if set).
+func (r *reconciler) callFunction(ctx context.Context, obj client.Object, caches clusterCaches, queries *queryLog) (effects *function.Effects, err error) {
+	fCtx, cancel := withTimeout(ctx, r.functionTimeout)
+	defer cancel()
+	if r.softDeadline > 0 {
+		fCtx = function.WithSoftDeadline(fCtx, time.Now().Add(r.softDeadline))
 	}
 
-	return reconcile.Result{}, nil
+	defer func() {
+		err = r.timeoutErr(ctx, fCtx, FunctionPhase, r.functionTimeout, r.panicErr(logr.FromContextOrDiscard(ctx), recover(), err))
+	}()
+	return r.f(fCtx, obj, r.getDetails(fCtx, caches, queries)) // r.getDetails() panics with query errors
 }
 
-type cache map[types.UID]client.Object
+// applyAll applies the effects of reconciling the owner, including those in other clusters.
+func (r *reconciler) applyAll(ctx context.Context, owner client.Object, caches clusterCaches, effects *function.Effects) error {
+	if effects == nil {
+		return nil
+	}
+	if err := ValidateEffects(effects, r.client.Scheme(), r.client.RESTMapper()); err != nil {
+		return errors.Wrap(err, "invalid effects")
+	}
+	if err := r.applyEffects(ctx, owner, caches[""], effects); err != nil {
+		return err
+	}
+	clusters := make([]string, 0, len(effects.Clusters))
+	for cluster := range effects.Clusters {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		clusterEffects := effects.Clusters[cluster]
+		if clusterEffects == nil {
+			continue
+		}
+		if len(clusterEffects.Clusters) > 0 {
+			return errors.Errorf("effects in cluster %q: nested Clusters are not supported", cluster)
+		}
+		remote, err := r.inCluster(cluster)
+		if err != nil {
+			return err
+		}
+		if err := remote.applyEffects(ctx, owner, caches.get(cluster), clusterEffects); err != nil {
+			return errors.Wrapf(err, "applying effects in cluster %q", cluster)
+		}
+	}
+	return nil
+}
 
-func panicErr(v interface{}, orig error) error {
-	if v != nil {
-		if err, isErr := v.(error); isErr {
+// applyEffects applies the effects (except Clusters) of reconciling the owner.
+func (r *reconciler) applyEffects(ctx context.Context, owner client.Object, cache cache, effects *function.Effects) error {
+	if r.setControllerRef {
+		if err := r.setControllerRefs(owner, effects.Persists); err != nil {
 			return err
 		}
-		panic(v) // v is not an error, re-throw :)
 	}
-	return orig
+	if r.ownerLabels {
+		if err := r.setOwnerLabels(owner, effects.Persists); err != nil {
+			return err
+		}
+	}
+	if r.observedGeneration && !r.remote {
+		setObservedGeneration(r.client.Scheme(), owner, effects.Persists)
+	}
+	if err := r.persistObjects(ctx, owner, cache, effects.Persists, effects.DependsOn); err != nil {
+		return err
+	}
+	if err := r.deleteObjects(ctx, effects.Deletes); err != nil {
+		return err
+	}
+	return r.prune(ctx, owner, effects.Prune, effects.Persists)
 }
 
-func (r *reconciler) getDetails(ctx context.Context, cache cache) function.GetDetails {
+type cache map[types.UID]client.Object
+
+func (r *reconciler) getDetails(ctx context.Context, caches clusterCaches, queries *queryLog) function.GetDetails {
 	return func(query function.Query) runtime.Object {
-		result, err := runQuery(ctx, r.client, cache, query)
+		if query.Cluster != "" {
+			remote, err := r.inCluster(query.Cluster)
+			if err != nil {
+				panic(queryPanic{err})
+			}
+			dep, _ := newDependency(r.client.Scheme(), query)
+			logged := loggedQuery{dependency: dep, cluster: query.Cluster}
+			queries.add(logged)
+			logr.FromContextOrDiscard(ctx).V(detailLogLevel).Info("query", "query", logged.String())
+			result, err := runQuery(ctx, remote.client, caches.get(query.Cluster), query)
+			if err != nil {
+				panic(queryPanic{err})
+			}
+			return result
+		}
+
+		dep, err := newDependency(r.client.Scheme(), query)
+		if err != nil && r.dependencies != nil {
+			panic(queryPanic{err})
+		}
+		var reader client.Reader = r.client
+		live := query.Live || r.behindWrites(ctx, query.Type, query.Namespace, query.Name)
+		if live {
+			if r.apiReader == nil {
+				panic(queryPanic{errors.Errorf("live query of %T: no API reader (see WithAPIReader)", query.Type)})
+			}
+			reader = r.apiReader
+		}
+		logged := loggedQuery{dependency: dep, live: live, uncached: query.Live}
+		queries.add(logged)
+		logr.FromContextOrDiscard(ctx).V(detailLogLevel).Info("query", "query", logged.String())
+
+		result, err := runQuery(ctx, reader, caches.get(""), query)
 		if err != nil {
-			panic(err)
+			panic(queryPanic{err})
 		}
 		return result
 	}
 }
 
-func (r *reconciler) persistObjects(ctx context.Context, cache cache, objects []client.Object) error {
-	persisted := make(persisted, len(objects))
-
-	for _, object := range objects {
-		object := object
-		if err := r.persist(ctx, cache, persisted, object); err != nil {
-			return err
-		}
+func (r *reconciler) persistObjects(ctx context.Context, owner client.Object, cache cache, objects []client.Object, dependsOn map[client.Object][]client.Object) error {
+	graph, err := newDependencyGraph(r.client.Scheme(), objects, dependsOn)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	state := &persistState{
+		scheme:    r.client.Scheme(),
+		cache:     cache,
+		persisted: make(persisted, len(objects)),
+	}
+	if !r.remote {
+		state.owner = owner
+	}
+	return graph.run(ctx, r.maxConcurrentPersists, func(ctx context.Context, object client.Object) error {
+		return r.persist(ctx, state, object)
+	})
 }
 
 func (r *reconciler) deleteObjects(ctx context.Context, objects []client.Object) error {
@@ -152,69 +329,187 @@ func (r *reconciler) deleteObjects(ctx context.Context, objects []client.Object)
 		if err := r.client.Delete(ctx, object); err != nil {
 			return err
 		}
+		r.trackWrite(object, true)
+		written(ctx, object, "deleted")
 	}
 	return nil
 }
 
 type persisted map[corev1.ObjectReference]client.Object
 
-func (persisted persisted) add(object client.Object) {
-	apiVersion, kind := object.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
-	persisted[corev1.ObjectReference{
+func (persisted persisted) add(scheme *runtime.Scheme, object client.Object) {
+	persisted[ref(scheme, object)] = object
+}
+
+// ref references the object by its GVK resolved with the scheme: typed objects usually have empty TypeMeta.
+func ref(scheme *runtime.Scheme, object client.Object) corev1.ObjectReference {
+	apiVersion, kind := gvkOf(scheme, object).ToAPIVersionAndKind()
+	return corev1.ObjectReference{
 		APIVersion: apiVersion,
 		Kind:       kind,
 		Namespace:  object.GetNamespace(),
 		Name:       object.GetName(),
-	}] = object
+	}
 }
 
-func (r *reconciler) persist(ctx context.Context, cache cache, persisted persisted, object client.Object) (retErr error) {
-	defer func() {
-		if retErr != nil {
-			return
-		}
-		persisted.add(object)
-	}()
-	if err := r.fixOwnerRefUIDs(persisted, object); err != nil {
+// sameObject tells whether the objects are the same one: e.g. the reconciled object and its copy without UID.
+func sameObject(scheme *runtime.Scheme, a, b client.Object) bool {
+	return (a.GetUID() != "" && a.GetUID() == b.GetUID()) || ref(scheme, a) == ref(scheme, b)
+}
+
+// gvkOf resolves GVK of the object with the scheme, falling back to the object's TypeMeta if the scheme doesn't know
+// its type.
+func gvkOf(scheme *runtime.Scheme, object runtime.Object) schema.GroupVersionKind {
+	if gvk, err := apiutil.GVKForObject(object, scheme); err == nil {
+		return gvk
+	}
+	return object.GetObjectKind().GroupVersionKind()
+}
+
+// persistState is shared by persist calls for the same Effects, which may run concurrently.
+type persistState struct {
+	sync.Mutex
+	scheme    *runtime.Scheme
+	owner     client.Object // the reconciled object, if in this cluster
+	cache     cache
+	persisted persisted
+}
+
+func (r *reconciler) persist(ctx context.Context, state *persistState, object client.Object) error {
+	state.Lock()
+	err := r.fixOwnerRefUIDs(state.persisted, object)
+	state.Unlock()
+	if err != nil {
 		return err
 	}
-	if object.GetUID() == "" {
-		existing := r.getDetails(ctx, cache)(function.Query{
+
+	// drift of the reconciled object itself is not detected: the Function usually persists it as read
+	detectDrift := r.driftDetection && (state.owner == nil || !sameObject(state.scheme, object, state.owner))
+
+	var cached client.Object
+	if object.GetUID() != "" {
+		state.Lock()
+		cached = state.cache[object.GetUID()]
+		state.Unlock()
+	}
+
+	if cached == nil {
+		fetched := cache{}
+		existing, err := runQuery(ctx, r.reader(ctx, object, object.GetNamespace(), object.GetName()), fetched, function.Query{
 			Type:      newEmpty(object),
 			Namespace: object.GetNamespace(),
 			Name:      object.GetName(),
 		})
+		if err != nil {
+			return err
+		}
 		if existing == nil {
-			return r.client.Create(ctx, object)
+			if detectDrift {
+				if err := setLastApplied(object); err != nil {
+					return err
+				}
+			}
+			if err := r.client.Create(ctx, object); err != nil {
+				return err
+			}
+			r.trackWrite(object, false)
+			written(ctx, object, "created")
+			state.added(object)
+			return nil
 		}
-		object.SetUID(existing.(client.Object).GetUID())
+		state.fetched(fetched)
+		cached = existing.(client.Object)
+		object.SetUID(cached.GetUID())
+	}
+
+	if err := r.patch(ctx, cached, object, detectDrift); err != nil {
+		return err
 	}
-	return r.patch(ctx, cache, object)
+	state.added(object)
+	return nil
+}
+
+func (state *persistState) fetched(fetched cache) {
+	state.Lock()
+	defer state.Unlock()
+	for uid, object := range fetched {
+		if _, exists := state.cache[uid]; !exists {
+			state.cache[uid] = object
+		}
+	}
+}
+
+func (state *persistState) added(object client.Object) {
+	state.Lock()
+	defer state.Unlock()
+	state.persisted.add(state.scheme, object)
 }
 
 func newEmpty(object client.Object) client.Object {
+	if u, isUnstructured := object.(*unstructured.Unstructured); isUnstructured {
+		empty := &unstructured.Unstructured{}
+		empty.SetGroupVersionKind(u.GroupVersionKind())
+		return empty
+	}
 	return reflect.New(reflect.TypeOf(object).Elem()).Interface().(client.Object)
 }
 
-func (r *reconciler) patch(ctx context.Context, cache cache, object client.Object) error {
-	cached := cache[object.GetUID()]
+// newObject creates an empty object of the GVK: typed, if it is known to the scheme, or unstructured otherwise.
+func newObject(scheme *runtime.Scheme, gvk schema.GroupVersionKind) (client.Object, error) {
+	if !scheme.Recognizes(gvk) {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		return u, nil
+	}
+	typed, err := scheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	object, isObject := typed.(client.Object)
+	if !isObject {
+		return nil, errors.Errorf("%s is not a client.Object", gvk)
+	}
+	return object, nil
+}
+
+func (r *reconciler) patch(ctx context.Context, cached client.Object, object client.Object, detectDrift bool) error {
+	var applied map[string]interface{}
+	if detectDrift {
+		applied = lastApplied(cached)
+		if err := setLastApplied(object); err != nil {
+			return err
+		}
+	}
+	if err := ignoreDrift(cached, object); err != nil {
+		return err
+	}
 	if reflect.DeepEqual(cached, object) {
+		written(ctx, object, "unchanged")
 		return nil
 	}
+	if applied != nil {
+		if err := r.reportDrift(ctx, cached, object, applied); err != nil {
+			return err
+		}
+	}
 	patch := client.MergeFromWithOptions(cached, client.MergeFromWithOptimisticLock{})
 	status := object.DeepCopyObject().(client.Object)
 	if err := r.client.Patch(ctx, object, patch); err != nil {
 		return err
 	}
-	if err := r.client.Status().Patch(ctx, status, patch); err != nil {
+	r.trackWrite(object, false)
+	written(ctx, object, "patched")
+	if err := r.client.Status().Patch(ctx, status, r.statusPatch(cached, object)); err != nil {
 		if !apierrors.IsNotFound(err) {
 			return err
 		}
+		return nil
 	}
+	r.trackWrite(status, false)
 	return nil
 }
 
-func runQuery(ctx context.Context, c client.Client, cache cache, query function.Query) (runtime.Object, error) {
+func runQuery(ctx context.Context, c client.Reader, cache cache, query function.Query) (runtime.Object, error) {
 	if query.Name == "" {
 		// get a list
 		list, castOK := query.Type.DeepCopyObject().(client.ObjectList)
@@ -240,9 +535,7 @@ func runQuery(ctx context.Context, c client.Client, cache cache, query function.
 		}
 		return nil, err
 	}
-	if _, exists := cache[object.GetUID()]; !exists {
-		cache[object.GetUID()] = object
-	}
+	cache.add(object)
 	return object, nil
 }
 
@@ -257,15 +550,40 @@ type noopListOption struct{}
 
 func (noopListOption) ApplyToList(*client.ListOptions) {}
 
+// add caches the object, unless it's already cached. Metadata-only objects are not cached: they can't be a base for
+// patching the persisted objects.
+func (c cache) add(object client.Object) {
+	if _, isMetadata := object.(*v1.PartialObjectMetadata); isMetadata {
+		return
+	}
+	if _, exists := c[object.GetUID()]; !exists {
+		c[object.GetUID()] = object
+	}
+}
+
 func addListToCache(cache cache, list client.ObjectList) {
-	items := reflect.ValueOf(list).Elem().FieldByName("Items")
-	for i := 0; i < items.Len(); i += 1 {
-		objValue := items.Index(i)
-		object := objValue.Addr().Interface().(client.Object)
-		if _, exists := cache[object.GetUID()]; !exists {
-			cache[object.GetUID()] = object
+	_ = meta.EachListItem(list, func(item runtime.Object) error {
+		cache.add(item.(client.Object))
+		return nil
+	})
+}
+
+func (r *reconciler) setControllerRefs(owner client.Object, objects []client.Object) error {
+	for _, object := range objects {
+		if sameObject(r.client.Scheme(), object, owner) {
+			continue
+		}
+		if owner.GetNamespace() != "" && object.GetNamespace() != owner.GetNamespace() {
+			continue
+		}
+		if v1.GetControllerOf(object) != nil {
+			continue
+		}
+		if err := controllerutil.SetControllerReference(owner, object, r.client.Scheme()); err != nil {
+			return errors.Wrapf(err, "setting controller reference on %s %s/%s", gvkOf(r.client.Scheme(), object), object.GetNamespace(), object.GetName())
 		}
 	}
+	return nil
 }
 
 func (r *reconciler) fixOwnerRefUIDs(persisted persisted, object client.Object) error {
@@ -274,7 +592,7 @@ func (r *reconciler) fixOwnerRefUIDs(persisted persisted, object client.Object)
 		if ownerRef.UID == "" {
 			persistedOwner, exists := persisted[objectRef(ownerRef, object.GetNamespace())]
 			if !exists {
-				return errors.Errorf("when persisting %s %s/%s, cannot find its ownerRef %+v in newly persisted objects: OwnerReferences referring to already existing objects should set UID", object.GetObjectKind().GroupVersionKind(), object.GetNamespace(), object.GetName(), ownerRef)
+				return errors.Errorf("when persisting %s %s/%s, cannot find its ownerRef %+v in newly persisted objects: OwnerReferences referring to already existing objects should set UID", gvkOf(r.client.Scheme(), object), object.GetNamespace(), object.GetName(), ownerRef)
 			}
 			ownerRefs[i].UID = persistedOwner.GetUID()
 		}
@@ -17,12 +17,21 @@ limitations under the License.
 package reconciler
 
 import (
+	"context"
 	"testing"
 
+	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
 )
 
 func TestAddListToCache(t *testing.T) {
@@ -51,13 +60,38 @@ func TestAddListToCache(t *testing.T) {
 
 func TestPanicWithArg(t *testing.T) {
 	expectedErr := errors.New("expected")
-	err := func() (retErr error) {
+	recovered := func(v interface{}) (retErr error) {
+		defer func() {
+			retErr = recoverPanic(recover(), retErr, logr.Discard(), "test")
+		}()
+		panic(v)
+	}
+	assert.Equal(t, expectedErr, recovered(queryPanic{expectedErr}))
+
+	err := recovered(expectedErr)
+	require.IsType(t, &PanicError{}, err)
+	assert.Equal(t, expectedErr, errors.Cause(err.(*PanicError).Unwrap()))
+}
+
+func TestRecoverQueryErrorInFunction(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+
+	var recovered error
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (_ *function.Effects, err error) {
 		defer func() {
-			retErr = panicErr(recover(), retErr)
+			recovered, _ = recover().(error)
+			err = recovered
 		}()
-		panic(expectedErr)
-	}()
-	assert.Equal(t, expectedErr, err)
+		getDetails(function.Query{Type: &corev1.ConfigMap{}, Namespace: "ns", Name: "primary", Live: true}) // no API reader
+		return nil, nil
+	})
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.Error(t, recovered)
+	assert.Contains(t, recovered.Error(), "no API reader")
+	assert.Equal(t, recovered, err)
+	assert.NotNil(t, errors.Unwrap(recovered))
 }
 
 func TestNewEmpty(t *testing.T) {
@@ -69,3 +103,56 @@ func TestNewEmpty(t *testing.T) {
 func TestReconciler(t *testing.T) {
 
 }
+
+func TestReconcileWithControllerReference(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	explicitOwner := metav1.OwnerReference{APIVersion: "v1", Kind: "Secret", Name: "other", UID: "other-uid", Controller: pointer.BoolPtr(true)}
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, object client.Object, _ function.GetDetails) (*function.Effects, error) {
+		owned, explicit, elsewhere := configMap("ns", "owned"), configMap("ns", "explicit"), configMap("other-ns", "elsewhere")
+		explicit.OwnerReferences = []metav1.OwnerReference{explicitOwner}
+		return &function.Effects{Persists: []client.Object{object, owned, explicit, elsewhere}}, nil
+	}, WithControllerReference())
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+
+	get := func(namespace, name string) *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, cm))
+		return cm
+	}
+	assert.Empty(t, get("ns", "primary").OwnerReferences)
+	assert.Equal(t, []metav1.OwnerReference{{
+		APIVersion:         "v1",
+		Kind:               "ConfigMap",
+		Name:               "primary",
+		UID:                "primary-uid",
+		Controller:         pointer.BoolPtr(true),
+		BlockOwnerDeletion: pointer.BoolPtr(true),
+	}}, get("ns", "owned").OwnerReferences)
+	assert.Equal(t, []metav1.OwnerReference{explicitOwner}, get("ns", "explicit").OwnerReferences)
+	assert.Empty(t, get("other-ns", "elsewhere").OwnerReferences)
+}
+
+func TestReconcilePrimaryCopyWithControllerReference(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		copied := configMap("ns", "primary") // without UID
+		copied.Data = map[string]string{"status": "ready"}
+		return &function.Effects{Persists: []client.Object{copied}}, nil
+	}, WithControllerReference())
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+
+	result := &corev1.ConfigMap{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKeyFromObject(primary), result))
+	assert.Equal(t, "ready", result.Data["status"])
+	assert.Empty(t, result.OwnerReferences)
+}
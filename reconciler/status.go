@@ -0,0 +1,72 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// statusPatch makes the merge patch for the status of object, based on cached with the object's new resourceVersion
+// (the patch of the object itself might have changed it).
+func (r *reconciler) statusPatch(cached, object client.Object) client.Patch {
+	base := cached.DeepCopyObject().(client.Object)
+	if !r.statusOptimisticLock {
+		return client.MergeFrom(base)
+	}
+	base.SetResourceVersion(object.GetResourceVersion())
+	return client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{})
+}
+
+// setObservedGeneration sets status.observedGeneration of the owner, if it is in objects, to the owner's generation.
+func setObservedGeneration(scheme *runtime.Scheme, owner client.Object, objects []client.Object) {
+	ownerRef := ref(scheme, owner)
+	for _, object := range objects {
+		if ref(scheme, object) == ownerRef {
+			observeGeneration(object, owner.GetGeneration())
+		}
+	}
+}
+
+// observeGeneration sets status.observedGeneration of the object, if it has the field: typed objects should have
+// a Status struct with an int64 ObservedGeneration field, unstructured objects should have a status.
+func observeGeneration(object client.Object, generation int64) {
+	if u, isUnstructured := object.(*unstructured.Unstructured); isUnstructured {
+		if _, hasStatus := u.Object["status"].(map[string]interface{}); hasStatus {
+			_ = unstructured.SetNestedField(u.Object, generation, "status", "observedGeneration")
+		}
+		return
+	}
+	v := reflect.ValueOf(object)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	status := v.Elem().FieldByName("Status")
+	if status.Kind() == reflect.Ptr {
+		status = status.Elem()
+	}
+	if status.Kind() != reflect.Struct {
+		return
+	}
+	observed := status.FieldByName("ObservedGeneration")
+	if observed.Kind() == reflect.Int64 && observed.CanSet() {
+		observed.SetInt(generation)
+	}
+}
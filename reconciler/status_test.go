@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// concurrentUpdateClient updates patched Deployments right after the patch, as if a user did it concurrently with
+// the reconciler.
+type concurrentUpdateClient struct {
+	client.Client
+}
+
+func (c concurrentUpdateClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	updated := &appsv1.Deployment{}
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), updated); err != nil {
+		return err
+	}
+	updated.Spec.Replicas = pointer.Int32Ptr(5)
+	return c.Client.Update(ctx, updated)
+}
+
+func deployment(namespace, name string) *appsv1.Deployment {
+	return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: "primary-uid", Generation: 3}}
+}
+
+func reconcileStatus(cl client.Client, opts ...Option) error {
+	r := New(cl, logr.Discard(), &appsv1.Deployment{}, func(_ context.Context, object client.Object, _ function.GetDetails) (*function.Effects, error) {
+		d := object.(*appsv1.Deployment)
+		d.Labels = map[string]string{"reconciled": "true"}
+		d.Status.Replicas = 1
+		return &function.Effects{Persists: []client.Object{d}}, nil
+	}, opts...)
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "app"}})
+	return err
+}
+
+func TestStatusOptimisticLock(t *testing.T) {
+	err := reconcileStatus(concurrentUpdateClient{newFakeClient(deployment("ns", "app"))})
+	assert.True(t, apierrors.IsConflict(err), "expected a conflict, got: %v", err)
+
+	cl := newFakeClient(deployment("ns", "app"))
+	require.NoError(t, reconcileStatus(concurrentUpdateClient{cl}, WithoutStatusOptimisticLock()))
+
+	d := &appsv1.Deployment{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "app"}, d))
+	assert.Equal(t, int32(1), d.Status.Replicas)
+	assert.Equal(t, int32(5), *d.Spec.Replicas)
+}
+
+func TestObservedGeneration(t *testing.T) {
+	cl := newFakeClient(deployment("ns", "app"))
+	require.NoError(t, reconcileStatus(cl, WithObservedGeneration()))
+
+	d := &appsv1.Deployment{}
+	require.NoError(t, cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "app"}, d))
+	assert.Equal(t, int64(3), d.Status.ObservedGeneration)
+}
+
+func TestObserveGeneration(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"status": map[string]interface{}{}}}
+	observeGeneration(u, 2)
+	observed, _, _ := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+	assert.Equal(t, int64(2), observed)
+
+	withoutStatus := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	observeGeneration(withoutStatus, 2)
+	assert.NotContains(t, withoutStatus.Object, "status")
+
+	cm := configMap("ns", "cm")
+	observeGeneration(cm, 2)
+	assert.Equal(t, configMap("ns", "cm"), cm)
+}
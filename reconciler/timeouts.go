@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Phase is a phase of reconcile with its own time budget (see WithTimeout, WithFunctionTimeout and WithApplyTimeout).
+type Phase string
+
+const (
+	// ReconcilePhase is the whole reconcile.
+	ReconcilePhase Phase = "reconcile"
+	// FunctionPhase is the call of the Function, including its queries.
+	FunctionPhase Phase = "function"
+	// ApplyPhase is applying the effects produced by the Function.
+	ApplyPhase Phase = "apply"
+)
+
+// TimeoutError is returned by Reconcile if a phase of it fails after exceeding its time budget.
+type TimeoutError struct {
+	Phase   Phase
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s: %v", e.Phase, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout tells if the error (or one it wraps) is a TimeoutError of the phase.
+func IsTimeout(err error, phase Phase) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr) && timeoutErr.Phase == phase
+}
+
+// withTimeout returns a copy of ctx with the timeout, unless it's 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutErr returns a TimeoutError wrapping `err` (if there is one), if a deadline of the reconcile (`ctx`) or of its
+// phase (`phaseCtx`) has been exceeded, or `err` as is otherwise.
+func (r *reconciler) timeoutErr(ctx, phaseCtx context.Context, phase Phase, timeout time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case r.timeout > 0 && ctx.Err() == context.DeadlineExceeded:
+		phase, timeout = ReconcilePhase, r.timeout
+	case timeout > 0 && phaseCtx.Err() == context.DeadlineExceeded:
+	default:
+		return err
+	}
+	timeouts.WithLabelValues(string(phase)).Inc()
+	return &TimeoutError{Phase: phase, Timeout: timeout, Err: err}
+}
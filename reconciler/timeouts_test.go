@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// slowClient blocks creating objects until the context is done.
+type slowClient struct {
+	client.Client
+}
+
+func (c slowClient) Create(ctx context.Context, _ client.Object, _ ...client.CreateOption) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func waitForDeadline(ctx context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestReconcileTimeouts(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	cl := slowClient{newFakeClient(primary)}
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+	createChild := func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		return &function.Effects{Persists: []client.Object{configMap("ns", "child")}}, nil
+	}
+
+	for _, tt := range []struct {
+		phase Phase
+		f     Function
+		opts  []Option
+	}{
+		{ReconcilePhase, waitForDeadline, []Option{WithTimeout(10 * time.Millisecond)}},
+		{FunctionPhase, waitForDeadline, []Option{WithTimeout(time.Minute), WithFunctionTimeout(10 * time.Millisecond)}},
+		{ApplyPhase, createChild, []Option{WithFunctionTimeout(10 * time.Millisecond), WithApplyTimeout(10 * time.Millisecond)}},
+		{ReconcilePhase, createChild, []Option{WithTimeout(10 * time.Millisecond), WithApplyTimeout(time.Minute)}},
+	} {
+		before := testutil.ToFloat64(timeouts.WithLabelValues(string(tt.phase)))
+		_, err := New(cl, logr.Discard(), &corev1.ConfigMap{}, tt.f, tt.opts...).Reconcile(context.Background(), request)
+		assert.True(t, IsTimeout(err, tt.phase), "%s: %v", tt.phase, err)
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err.(*TimeoutError).Err))
+		assert.Equal(t, before+1, testutil.ToFloat64(timeouts.WithLabelValues(string(tt.phase))))
+	}
+
+	expectedErr := errors.New("expected")
+	_, err := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		return nil, expectedErr
+	}, WithFunctionTimeout(time.Minute)).Reconcile(context.Background(), request)
+	assert.Equal(t, expectedErr, err, "errors before the deadline are returned as is")
+}
+
+func TestReconcileSoftDeadline(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)}
+
+	var deadline time.Time
+	var hasDeadline bool
+	f := func(ctx context.Context, _ client.Object, _ function.GetDetails) (*function.Effects, error) {
+		deadline, hasDeadline = function.SoftDeadline(ctx)
+		return nil, nil
+	}
+
+	_, err := New(cl, logr.Discard(), &corev1.ConfigMap{}, f).Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.False(t, hasDeadline)
+
+	start := time.Now()
+	_, err = New(cl, logr.Discard(), &corev1.ConfigMap{}, f, WithSoftDeadline(time.Minute)).Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, start.Add(time.Minute), deadline, time.Second)
+}
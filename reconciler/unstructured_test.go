@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func unstructuredConfigMap(namespace, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(configMapGVK)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func TestNewEmptyUnstructured(t *testing.T) {
+	u := unstructuredConfigMap("ns", "cm")
+	assert.Equal(t, unstructuredConfigMap("", ""), newEmpty(u))
+}
+
+func TestNewObject(t *testing.T) {
+	object, err := newObject(newFakeClient().Scheme(), configMapGVK)
+	require.NoError(t, err)
+	assert.Equal(t, &corev1.ConfigMap{}, object)
+
+	unknownGVK := schema.GroupVersionKind{Group: "example.org", Version: "v1", Kind: "Unknown"}
+	object, err = newObject(newFakeClient().Scheme(), unknownGVK)
+	require.NoError(t, err)
+	assert.Equal(t, unknownGVK, object.GetObjectKind().GroupVersionKind())
+}
+
+func TestReconcileUnstructured(t *testing.T) {
+	widgetGVK := schema.GroupVersionKind{Group: "example.org", Version: "v1", Kind: "Widget"}
+	widget := func(name string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(widgetGVK)
+		u.SetNamespace("ns")
+		u.SetName(name)
+		return u
+	}
+	primary, stale := widget("primary"), widget("stale")
+	primary.SetUID("primary-uid")
+	stale.SetUID("stale-uid")
+	cl := uidClient{fake.NewClientBuilder().WithScheme(runtime.NewScheme()).WithObjects(primary, stale).Build()}
+	listType := &unstructured.UnstructuredList{}
+	listType.SetGroupVersionKind(widgetGVK.GroupVersion().WithKind("WidgetList"))
+
+	var listed []string
+	r := New(cl, logr.Discard(), widget(""), func(_ context.Context, object client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		list := getDetails(function.Query{Type: listType, Namespace: "ns"}).(*unstructured.UnstructuredList)
+		listed = nil
+		for _, item := range list.Items {
+			listed = append(listed, item.GetName())
+		}
+
+		primary := object.(*unstructured.Unstructured)
+		require.NoError(t, unstructured.SetNestedField(primary.Object, "value", "spec", "key"))
+		return &function.Effects{
+			Persists: []client.Object{primary, widget("child")},
+			Deletes:  []client.Object{widget("stale")},
+		}, nil
+	})
+
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"primary", "stale"}, listed)
+
+	list := listType.DeepCopy()
+	require.NoError(t, cl.List(context.Background(), list))
+	require.Len(t, list.Items, 2)
+	assert.Equal(t, "child", list.Items[0].GetName())
+	assert.Equal(t, "primary", list.Items[1].GetName())
+	value, _, _ := unstructured.NestedString(list.Items[1].Object, "spec", "key")
+	assert.Equal(t, "value", value)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// ValidateEffects checks the Effects (e.g. produced by your Function in a test) for errors that would otherwise only
+// surface when applying them, possibly after some objects have been written:
+//   - objects with no name, or of types unknown to the scheme
+//   - objects listed more than once, or both in Persists and Deletes
+//   - namespaced objects with no namespace, and cluster-scoped ones with a namespace (if `mapper` is not nil)
+//   - DependsOn listing objects not in Persists, and dependency cycles (including those of OwnerReferences)
+//
+// Effects in other clusters (see function.Effects Clusters) are checked with the scheme only. The reconciler validates
+// the Effects returned by the Function before applying any of them.
+func ValidateEffects(effects *function.Effects, scheme *runtime.Scheme, mapper meta.RESTMapper) error {
+	if effects == nil {
+		return nil
+	}
+	v := validator{scheme: scheme, mapper: mapper, seen: map[objectID]string{}}
+	for i, object := range effects.Persists {
+		v.object(fmt.Sprintf("Persists[%d]", i), object)
+	}
+	for i, object := range effects.Deletes {
+		v.object(fmt.Sprintf("Deletes[%d]", i), object)
+	}
+	v.dependsOn(effects)
+	for i, listType := range effects.Prune {
+		if _, err := queryGVK(scheme, listType); err != nil {
+			v.errs = append(v.errs, errors.Wrapf(err, "Prune[%d]", i))
+		}
+	}
+
+	clusters := make([]string, 0, len(effects.Clusters))
+	for cluster := range effects.Clusters {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		if err := ValidateEffects(effects.Clusters[cluster], scheme, nil); err != nil {
+			v.errs = append(v.errs, errors.Wrapf(err, "Clusters[%q]", cluster))
+		}
+	}
+	return utilerrors.NewAggregate(v.errs)
+}
+
+// objectID identifies an object in Effects.
+type objectID struct {
+	gvk       schema.GroupVersionKind
+	namespace string
+	name      string
+}
+
+type validator struct {
+	scheme *runtime.Scheme
+	mapper meta.RESTMapper
+	seen   map[objectID]string
+	errs   []error
+}
+
+func (v *validator) object(path string, object client.Object) {
+	if object == nil {
+		v.errs = append(v.errs, errors.Errorf("%s: nil object", path))
+		return
+	}
+	if object.GetName() == "" {
+		v.errs = append(v.errs, errors.Errorf("%s: %T has no name", path, object))
+	}
+	gvk, err := apiutil.GVKForObject(object, v.scheme)
+	if err != nil {
+		v.errs = append(v.errs, errors.Wrapf(err, "%s: resolving GVK of %T", path, object))
+		return
+	}
+	id := objectID{gvk: gvk, namespace: object.GetNamespace(), name: object.GetName()}
+	if seenAt, seen := v.seen[id]; seen {
+		v.errs = append(v.errs, errors.Errorf("%s: %s %s/%s is already in %s", path, gvk.Kind, id.namespace, id.name, seenAt))
+	} else {
+		v.seen[id] = path
+	}
+
+	if v.mapper == nil {
+		return
+	}
+	mapping, err := v.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		v.errs = append(v.errs, errors.Wrapf(err, "%s: mapping %s", path, gvk))
+		return
+	}
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	switch {
+	case namespaced && id.namespace == "":
+		v.errs = append(v.errs, errors.Errorf("%s: %s %s is namespaced, but has no namespace", path, gvk.Kind, id.name))
+	case !namespaced && id.namespace != "":
+		v.errs = append(v.errs, errors.Errorf("%s: %s %s is cluster-scoped, but has namespace %s", path, gvk.Kind, id.name, id.namespace))
+	}
+}
+
+// dependsOn checks that objects in DependsOn are persisted, and don't depend on each other in a cycle.
+func (v *validator) dependsOn(effects *function.Effects) {
+	if len(effects.DependsOn) == 0 {
+		return
+	}
+	for _, object := range effects.Persists {
+		if object == nil {
+			return // already reported
+		}
+	}
+	for object, dependencies := range effects.DependsOn {
+		if object == nil {
+			v.errs = append(v.errs, errors.New("DependsOn: nil object"))
+			return
+		}
+		for _, dependency := range dependencies {
+			if dependency == nil {
+				v.errs = append(v.errs, errors.Errorf("DependsOn: %T %s/%s depends on nil object", object, object.GetNamespace(), object.GetName()))
+				return
+			}
+		}
+	}
+	if _, err := newDependencyGraph(v.scheme, effects.Persists, effects.DependsOn); err != nil {
+		v.errs = append(v.errs, errors.Wrap(err, "DependsOn"))
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func testRESTMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(configMapGVK, meta.RESTScopeNamespace)
+	mapper.Add(rbacv1.SchemeGroupVersion.WithKind("ClusterRole"), meta.RESTScopeRoot)
+	return mapper
+}
+
+func TestValidateEffects(t *testing.T) {
+	clusterRole := &rbacv1.ClusterRole{}
+	clusterRole.Name = "role"
+	unknown := &unstructured.Unstructured{}
+	unknown.SetGroupVersionKind(schema.GroupVersionKind{Group: "example.org", Version: "v1", Kind: "Widget"})
+	unknown.SetNamespace("ns")
+	unknown.SetName("widget")
+
+	valid := &function.Effects{
+		Persists: []client.Object{configMap("ns", "a"), clusterRole},
+		Deletes:  []client.Object{configMap("ns", "b")},
+		Prune:    []client.ObjectList{&corev1.ConfigMapList{}},
+		Clusters: map[string]*function.Effects{"remote": {Persists: []client.Object{configMap("ns", "a"), unknown}}},
+	}
+	assert.NoError(t, ValidateEffects(valid, clientgoscheme.Scheme, testRESTMapper()))
+	assert.NoError(t, ValidateEffects(nil, clientgoscheme.Scheme, testRESTMapper()))
+
+	namespacedRole := clusterRole.DeepCopy()
+	namespacedRole.Name, namespacedRole.Namespace = "namespaced", "ns"
+	invalid := &function.Effects{
+		Persists: []client.Object{configMap("ns", ""), configMap("", "no-namespace"), namespacedRole, configMap("ns", "a"), unknown},
+		Deletes:  []client.Object{configMap("ns", "a")},
+		Prune:    []client.ObjectList{&unstructured.UnstructuredList{}},
+		Clusters: map[string]*function.Effects{"remote": {Persists: []client.Object{configMap("ns", "a"), configMap("ns", "a")}}},
+	}
+	err := ValidateEffects(invalid, clientgoscheme.Scheme, testRESTMapper())
+	require.Error(t, err)
+	var messages []string
+	for _, err := range err.(utilerrors.Aggregate).Errors() {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		"Persists[0]: *v1.ConfigMap has no name",
+		"Persists[1]: ConfigMap no-namespace is namespaced, but has no namespace",
+		"Persists[2]: ClusterRole namespaced is cluster-scoped, but has namespace ns",
+		`Persists[4]: mapping example.org/v1, Kind=Widget: no matches for kind "Widget" in version "example.org/v1"`,
+		"Deletes[0]: ConfigMap ns/a is already in Persists[3]",
+		"Prune[0]: Object 'Kind' is missing in 'unstructured object has no kind'",
+		`Clusters["remote"]: Persists[1]: ConfigMap ns/a is already in Persists[0]`,
+	}, messages)
+}
+
+func TestValidateDependsOn(t *testing.T) {
+	a, b, missing := configMap("ns", "a"), configMap("ns", "b"), configMap("ns", "missing")
+	assert.NoError(t, ValidateEffects(&function.Effects{
+		Persists:  []client.Object{a, b},
+		DependsOn: map[client.Object][]client.Object{b: {a}},
+	}, clientgoscheme.Scheme, nil))
+
+	err := ValidateEffects(&function.Effects{
+		Persists: []client.Object{a, b},
+		Clusters: map[string]*function.Effects{
+			"cycle":   {Persists: []client.Object{a, b}, DependsOn: map[client.Object][]client.Object{a: {b}, b: {a}}},
+			"missing": {Persists: []client.Object{a}, DependsOn: map[client.Object][]client.Object{a: {missing}}},
+		},
+	}, clientgoscheme.Scheme, nil)
+	require.Error(t, err)
+	var messages []string
+	for _, err := range err.(utilerrors.Aggregate).Errors() {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal(t, []string{
+		`Clusters["cycle"]: DependsOn: dependency cycle in Persists list involving /v1, Kind=ConfigMap ns/a`,
+		`Clusters["missing"]: DependsOn: /v1, Kind=ConfigMap ns/a depends on /v1, Kind=ConfigMap ns/missing, which is not in Persists list`,
+	}, messages)
+}
+
+func TestReconcileInvalidEffects(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(context.Context, client.Object, function.GetDetails) (*function.Effects, error) {
+		return &function.Effects{Persists: []client.Object{configMap("ns", "valid"), configMap("ns", "")}}, nil
+	})
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	assert.Error(t, err)
+	assert.True(t, apierrors.IsNotFound(cl.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "valid"}, &corev1.ConfigMap{})), "nothing is applied")
+}
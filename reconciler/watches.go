@@ -0,0 +1,306 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	crcache "sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// SetupWithManager builds the controller configured by `bldr` (e.g. ctrl.NewControllerManagedBy(mgr).For(objType))
+// with this reconciler. Events of reconciled objects are filtered with the reconciler's predicates (see
+// DefaultPredicates and WithPredicates), except changes of the pause annotation (see WithPauseAnnotation) are always let
+// through. With WithDerivedWatches, the reconciler then starts watches of queried types
+// on this controller.
+func (r *reconciler) SetupWithManager(mgr ctrl.Manager, bldr *builder.Builder) error {
+	if len(r.predicates) > 0 {
+		gvk, err := apiutil.GVKForObject(r.objType, mgr.GetScheme())
+		if err != nil {
+			return err
+		}
+		bldr = bldr.WithEventFilter(forPrimary{
+			Predicate: r.primaryPredicate(),
+			scheme:    mgr.GetScheme(),
+			gvk:       gvk,
+		})
+	}
+	c, err := bldr.Build(r)
+	if err != nil {
+		return err
+	}
+	if r.dependencies != nil {
+		r.watches.setController(c, mgr.GetCache())
+	}
+	return nil
+}
+
+// primaryPredicate filters events of reconciled objects with the reconciler's predicates, letting through updates
+// changing the pause annotation.
+func (r *reconciler) primaryPredicate() predicate.Predicate {
+	p := predicate.And(r.predicates...)
+	if r.pauseAnnotation != "" {
+		p = predicate.Or(p, AnnotationChanged(r.pauseAnnotation))
+	}
+	return p
+}
+
+// dependency describes objects some reconciled object depends on: those matching a query issued by its Function.
+type dependency struct {
+	gvk          schema.GroupVersionKind
+	namespace    string
+	name         string
+	selector     labels.Selector
+	metadataOnly bool
+}
+
+func newDependency(scheme *runtime.Scheme, query function.Query) (dependency, error) {
+	gvk, err := queryGVK(scheme, query.Type)
+	if err != nil {
+		return dependency{}, err
+	}
+	listOpts := (&client.ListOptions{}).ApplyOptions(query.Options)
+	dep := dependency{
+		gvk:          gvk,
+		namespace:    query.Namespace,
+		name:         query.Name,
+		selector:     listOpts.LabelSelector,
+		metadataOnly: query.IsMetadataOnly(),
+	}
+	if query.Selector != nil {
+		dep.selector = query.Selector
+	}
+	return dep, nil
+}
+
+// queryGVK returns GVK of objects queried by function.Query with `queryType` (a client.Object or client.ObjectList).
+func queryGVK(scheme *runtime.Scheme, queryType runtime.Object) (schema.GroupVersionKind, error) {
+	gvk, err := apiutil.GVKForObject(queryType, scheme)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	if _, isList := queryType.(client.ObjectList); isList {
+		gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	}
+	return gvk, nil
+}
+
+func (d dependency) matches(gvk schema.GroupVersionKind, object client.Object) bool {
+	if d.gvk != gvk {
+		return false
+	}
+	if d.namespace != "" && d.namespace != object.GetNamespace() {
+		return false
+	}
+	if d.name != "" && d.name != object.GetName() {
+		return false
+	}
+	return d.selector == nil || d.selector.Matches(labels.Set(object.GetLabels()))
+}
+
+// queryLog records queries issued by the Function during a single reconcile.
+type queryLog struct {
+	sync.Mutex
+	queries []loggedQuery
+}
+
+// loggedQuery records objects a query was issued for, and how they were read.
+type loggedQuery struct {
+	dependency
+	// live is set if the objects were read with the API reader, rather than from the cache.
+	live bool
+	// uncached is set if the query asked for a live read (see function.Query Live): it doesn't start derived watches.
+	uncached bool
+	// cluster is the name of the queried cluster, if it's not the reconciled object's: it doesn't start derived watches.
+	cluster string
+}
+
+func (l *queryLog) add(query loggedQuery) {
+	l.Lock()
+	defer l.Unlock()
+	l.queries = append(l.queries, query)
+}
+
+// dependencies returns dependencies on objects that can be watched: those of queries not asking for live reads, in the
+// reconciled object's cluster.
+func (l *queryLog) dependencies() []dependency {
+	l.Lock()
+	defer l.Unlock()
+	var deps []dependency
+	for _, query := range l.queries {
+		if !query.uncached && query.cluster == "" {
+			deps = append(deps, query.dependency)
+		}
+	}
+	return deps
+}
+
+// dependencyIndex maps objects to reconciled (primary) objects depending on them.
+type dependencyIndex struct {
+	sync.RWMutex
+	byPrimary map[types.NamespacedName][]dependency
+	index     map[schema.GroupVersionKind]map[string]map[types.NamespacedName][]dependency // by GVK, namespace ("" for all)
+}
+
+func newDependencyIndex() *dependencyIndex {
+	return &dependencyIndex{
+		byPrimary: map[types.NamespacedName][]dependency{},
+		index:     map[schema.GroupVersionKind]map[string]map[types.NamespacedName][]dependency{},
+	}
+}
+
+// set replaces dependencies of the primary object.
+func (idx *dependencyIndex) set(primary types.NamespacedName, deps []dependency) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.forgetLocked(primary)
+	if len(deps) == 0 {
+		return
+	}
+	idx.byPrimary[primary] = deps
+	for _, dep := range deps {
+		byNamespace := idx.index[dep.gvk]
+		if byNamespace == nil {
+			byNamespace = map[string]map[types.NamespacedName][]dependency{}
+			idx.index[dep.gvk] = byNamespace
+		}
+		primaries := byNamespace[dep.namespace]
+		if primaries == nil {
+			primaries = map[types.NamespacedName][]dependency{}
+			byNamespace[dep.namespace] = primaries
+		}
+		primaries[primary] = append(primaries[primary], dep)
+	}
+}
+
+func (idx *dependencyIndex) forget(primary types.NamespacedName) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.forgetLocked(primary)
+}
+
+func (idx *dependencyIndex) forgetLocked(primary types.NamespacedName) {
+	for _, dep := range idx.byPrimary[primary] {
+		byNamespace := idx.index[dep.gvk]
+		delete(byNamespace[dep.namespace], primary)
+		if len(byNamespace[dep.namespace]) == 0 {
+			delete(byNamespace, dep.namespace)
+		}
+		if len(byNamespace) == 0 {
+			delete(idx.index, dep.gvk)
+		}
+	}
+	delete(idx.byPrimary, primary)
+}
+
+// requests returns requests for primary objects depending on the `gvk` object.
+func (idx *dependencyIndex) requests(gvk schema.GroupVersionKind, object client.Object) []reconcile.Request {
+	idx.RLock()
+	defer idx.RUnlock()
+	var result []reconcile.Request
+	seen := map[types.NamespacedName]bool{}
+	for _, namespace := range []string{object.GetNamespace(), ""} {
+		for primary, deps := range idx.index[gvk][namespace] {
+			if seen[primary] {
+				continue
+			}
+			for _, dep := range deps {
+				if dep.matches(gvk, object) {
+					seen[primary] = true
+					result = append(result, reconcile.Request{NamespacedName: primary})
+					break
+				}
+			}
+		}
+		if namespace == "" {
+			break
+		}
+	}
+	return result
+}
+
+// watchStarter starts watches for GVKs the reconciled objects depend on, once per GVK.
+type watchStarter struct {
+	sync.Mutex
+	controller controller.Controller
+	cache      crcache.Cache
+	started    map[schema.GroupVersionKind]bool
+}
+
+func (w *watchStarter) setController(c controller.Controller, cache crcache.Cache) {
+	w.Lock()
+	defer w.Unlock()
+	w.controller = c
+	w.cache = cache
+}
+
+func (r *reconciler) updateDependencies(primary types.NamespacedName, queries *queryLog) {
+	deps := queries.dependencies()
+
+	r.dependencies.set(primary, deps)
+
+	w := &r.watches
+	w.Lock()
+	defer w.Unlock()
+	if w.controller == nil {
+		return
+	}
+	if w.started == nil {
+		w.started = map[schema.GroupVersionKind]bool{}
+	}
+	for _, dep := range deps {
+		if w.started[dep.gvk] {
+			continue
+		}
+		if err := r.startWatch(dep.gvk, dep.metadataOnly); err != nil {
+			r.logger.Error(err, "starting derived watch", "gvk", dep.gvk)
+			continue
+		}
+		w.started[dep.gvk] = true
+	}
+}
+
+// startWatch starts a watch of `gvk` objects: a metadata-only one (backed by a metadata informer), if the dependency
+// starting it is metadata-only.
+func (r *reconciler) startWatch(gvk schema.GroupVersionKind, metadataOnly bool) error {
+	var object client.Object = function.Metadata(gvk)
+	if !metadataOnly {
+		var err error
+		if object, err = newObject(r.client.Scheme(), gvk); err != nil {
+			return err
+		}
+	}
+	return r.watches.controller.Watch(source.NewKindWithCache(object, r.watches.cache), handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
+		return r.dependencies.requests(gvk, object)
+	}))
+}
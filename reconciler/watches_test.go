@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+func TestDependencyIndex(t *testing.T) {
+	idx := newDependencyIndex()
+	a := types.NamespacedName{Namespace: "ns", Name: "a"}
+	b := types.NamespacedName{Namespace: "ns", Name: "b"}
+	idx.set(a, []dependency{{gvk: configMapGVK, namespace: "ns", selector: labels.SelectorFromSet(labels.Set{"app": "a"})}})
+	idx.set(b, []dependency{{gvk: configMapGVK, name: "b-config"}})
+
+	cm := configMap("ns", "b-config")
+	assert.Equal(t, []reconcile.Request{{NamespacedName: b}}, idx.requests(configMapGVK, cm))
+
+	cm.Labels = map[string]string{"app": "a"}
+	assert.ElementsMatch(t, []reconcile.Request{{NamespacedName: a}, {NamespacedName: b}}, idx.requests(configMapGVK, cm))
+	assert.Empty(t, idx.requests(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, cm))
+
+	cm.Namespace = "other-ns"
+	assert.Equal(t, []reconcile.Request{{NamespacedName: b}}, idx.requests(configMapGVK, cm))
+
+	idx.forget(b)
+	assert.Empty(t, idx.requests(configMapGVK, cm))
+	idx.set(a, nil)
+	assert.Empty(t, idx.index)
+}
+
+func TestReconcileDerivesWatches(t *testing.T) {
+	primary := configMap("ns", "primary")
+	cl := newFakeClient(primary)
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		getDetails(function.Query{Type: &corev1.SecretList{}, Namespace: "ns", Options: []client.ListOption{client.MatchingLabels{"app": "x"}}})
+		getDetails(function.Query{Type: &corev1.Secret{}, Namespace: "ns", Name: "credentials"})
+		return nil, nil
+	}, WithDerivedWatches())
+	c := &fakeController{}
+	r.watches.setController(c, nil)
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	for i := 0; i < 2; i++ {
+		_, err := r.Reconcile(context.Background(), request)
+		require.NoError(t, err)
+	}
+	assert.Len(t, c.watches, 1)
+
+	secretGVK := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name = "ns", "credentials"
+	assert.Equal(t, []reconcile.Request{request}, r.dependencies.requests(secretGVK, secret))
+	secret.Name, secret.Labels = "other", map[string]string{"app": "x"}
+	assert.Equal(t, []reconcile.Request{request}, r.dependencies.requests(secretGVK, secret))
+	secret.Labels = nil
+	assert.Empty(t, r.dependencies.requests(secretGVK, secret))
+
+	require.NoError(t, cl.Delete(context.Background(), primary))
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Empty(t, r.dependencies.index)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// writeTTL limits how long a write is tracked: if the cache still doesn't reflect it by then, it most likely never
+// will (e.g. someone else has modified the object since).
+const writeTTL = time.Minute
+
+// writeTracker remembers writes issued by the reconciler until the (informer cache backed) client reflects them.
+type writeTracker struct {
+	sync.Mutex
+	writes map[writeKey]trackedWrite
+	now    func() time.Time
+}
+
+type writeKey struct {
+	gvk       schema.GroupVersionKind
+	namespace string
+	name      string
+}
+
+type trackedWrite struct {
+	resourceVersion string
+	deleted         bool
+	at              time.Time
+}
+
+func newWriteTracker() *writeTracker {
+	return &writeTracker{
+		writes: map[writeKey]trackedWrite{},
+		now:    time.Now,
+	}
+}
+
+func (t *writeTracker) track(key writeKey, write trackedWrite) {
+	t.Lock()
+	defer t.Unlock()
+	write.at = t.now()
+	t.writes[key] = write
+}
+
+// pending returns tracked writes of `gvk` objects (in `namespace` and with `name`, if these are set).
+func (t *writeTracker) pending(gvk schema.GroupVersionKind, namespace, name string) map[writeKey]trackedWrite {
+	t.Lock()
+	defer t.Unlock()
+	result := map[writeKey]trackedWrite{}
+	for key, write := range t.writes {
+		if t.now().Sub(write.at) > writeTTL {
+			delete(t.writes, key)
+			continue
+		}
+		if key.gvk != gvk || namespace != "" && key.namespace != namespace || name != "" && key.name != name {
+			continue
+		}
+		result[key] = write
+	}
+	return result
+}
+
+// caughtUp forgets the write, if it hasn't been overwritten by a newer one.
+func (t *writeTracker) caughtUp(key writeKey, write trackedWrite) {
+	t.Lock()
+	defer t.Unlock()
+	if t.writes[key] == write {
+		delete(t.writes, key)
+	}
+}
+
+func (r *reconciler) trackWrite(object client.Object, deleted bool) {
+	if r.writes == nil {
+		return
+	}
+	gvk, err := apiutil.GVKForObject(object, r.client.Scheme())
+	if err != nil {
+		return // we can't read objects of unknown types anyway
+	}
+	r.writes.track(writeKey{gvk: gvk, namespace: object.GetNamespace(), name: object.GetName()}, trackedWrite{
+		resourceVersion: object.GetResourceVersion(),
+		deleted:         deleted,
+	})
+}
+
+// reader returns the reader to query objects of `queryType` (a client.Object or client.ObjectList) with: r.client, if
+// it already reflects all our writes to the queried objects, or the API reader otherwise.
+func (r *reconciler) reader(ctx context.Context, queryType runtime.Object, namespace, name string) client.Reader {
+	if r.behindWrites(ctx, queryType, namespace, name) {
+		return r.apiReader
+	}
+	return r.client
+}
+
+// behindWrites tells if r.client doesn't yet reflect some of our writes to the queried objects.
+func (r *reconciler) behindWrites(ctx context.Context, queryType runtime.Object, namespace, name string) bool {
+	if r.writes == nil {
+		return false
+	}
+	gvk, err := queryGVK(r.client.Scheme(), queryType)
+	if err != nil {
+		return false
+	}
+
+	for key, write := range r.writes.pending(gvk, namespace, name) {
+		if !r.reflects(ctx, key, write) {
+			return true
+		}
+		r.writes.caughtUp(key, write)
+	}
+	return false
+}
+
+func (r *reconciler) reflects(ctx context.Context, key writeKey, write trackedWrite) bool {
+	object, err := newObject(r.client.Scheme(), key.gvk)
+	if err != nil {
+		return false
+	}
+	if err := r.client.Get(ctx, client.ObjectKey{Namespace: key.namespace, Name: key.name}, object); err != nil {
+		return write.deleted && apierrors.IsNotFound(err)
+	}
+	return !write.deleted && object.GetResourceVersion() == write.resourceVersion
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021 Ivan Mikushin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/imikushin/controllers-af/function"
+)
+
+// laggingClient writes to the embedded client, but reads from `cached`, which is only updated by sync().
+type laggingClient struct {
+	client.Client
+	cached *client.Client
+}
+
+func (c laggingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return (*c.cached).Get(ctx, key, obj)
+}
+
+func (c laggingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return (*c.cached).List(ctx, list, opts...)
+}
+
+func (c laggingClient) sync(t *testing.T) {
+	list := &corev1.ConfigMapList{}
+	require.NoError(t, c.Client.List(context.Background(), list))
+	builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme)
+	for i := range list.Items {
+		builder = builder.WithObjects(&list.Items[i])
+	}
+	*c.cached = builder.Build()
+}
+
+func TestReconcileReadsYourWrites(t *testing.T) {
+	primary := configMap("ns", "primary")
+	primary.UID = "primary-uid"
+	api := newFakeClient(primary)
+	cl := laggingClient{Client: api, cached: new(client.Client)}
+	cl.sync(t)
+
+	var listed []string
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		cms := getDetails(function.Query{Type: &corev1.ConfigMapList{}, Namespace: "ns"}).(*corev1.ConfigMapList)
+		listed = nil
+		for _, cm := range cms.Items {
+			listed = append(listed, cm.Name)
+		}
+		if len(cms.Items) > 1 {
+			return nil, nil
+		}
+		return &function.Effects{Persists: []client.Object{configMap("ns", "child")}}, nil
+	}, WithAPIReader(api))
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "primary"}}
+	_, err := r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary"}, listed)
+
+	_, err = r.Reconcile(context.Background(), request) // would fail creating "child" again, if reading from the cache
+	require.NoError(t, err)
+	assert.Equal(t, []string{"child", "primary"}, listed)
+	assert.Len(t, r.writes.writes, 1)
+
+	cl.sync(t)
+	_, err = r.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"child", "primary"}, listed)
+	assert.Empty(t, r.writes.writes)
+}
+
+func TestLiveQuery(t *testing.T) {
+	primary := configMap("ns", "primary")
+	secret := &corev1.Secret{}
+	secret.Namespace, secret.Name = "ns", "credentials"
+	api := newFakeClient(primary, secret)
+	cl := laggingClient{Client: api, cached: new(client.Client)}
+	cl.sync(t) // only ConfigMaps are cached
+
+	r := New(cl, logr.Discard(), &corev1.ConfigMap{}, nil, WithAPIReader(api), WithDerivedWatches())
+	queries := &queryLog{}
+	getDetails := r.getDetails(context.Background(), clusterCaches{}, queries)
+
+	assert.Nil(t, getDetails(function.Query{Type: &corev1.Secret{}, Namespace: "ns", Name: "credentials"}))
+	assert.NotNil(t, getDetails(function.Query{Type: &corev1.Secret{}, Namespace: "ns", Name: "credentials", Live: true}))
+	assert.NotNil(t, getDetails(function.Query{Type: &corev1.ConfigMap{}, Namespace: "ns", Name: "primary"}))
+
+	require.Len(t, queries.queries, 3)
+	assert.False(t, queries.queries[0].live)
+	assert.True(t, queries.queries[1].live)
+	assert.False(t, queries.queries[2].live)
+	deps := queries.dependencies()
+	require.Len(t, deps, 2)
+	assert.Equal(t, "Secret", deps[0].gvk.Kind)
+	assert.Equal(t, "ConfigMap", deps[1].gvk.Kind)
+
+	r = New(cl, logr.Discard(), &corev1.ConfigMap{}, func(_ context.Context, _ client.Object, getDetails function.GetDetails) (*function.Effects, error) {
+		getDetails(function.Query{Type: &corev1.Secret{}, Namespace: "ns", Name: "credentials", Live: true})
+		return nil, nil
+	})
+	_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(primary)})
+	assert.Error(t, err, "live queries require an API reader")
+}